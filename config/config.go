@@ -8,11 +8,14 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/cli/cli/compose/loader"
 	"github.com/docker/cli/cli/compose/types"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/policy"
 )
 
 func buildEnvironment() map[string]string {
@@ -56,20 +59,27 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	env := buildEnvironment()
+	redeploy, err := loadRedeploy(data, env)
+	if err != nil {
+		return nil, err
+	}
+
 	dockerConfig, err := loader.Load(types.ConfigDetails{
 		ConfigFiles: []types.ConfigFile{{
 			Filename: filename,
 			Config:   data,
 		}},
 		WorkingDir:  workdir,
-		Environment: buildEnvironment(),
+		Environment: env,
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	config := &Config{
-		Config: *dockerConfig,
+		Config:   *dockerConfig,
+		Redeploy: redeploy,
 	}
 	for _, service := range dockerConfig.Services {
 		config.Services = append(config.Services, Service(service))
@@ -86,6 +96,9 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	// Checked by Validate
+	config.Services, _ = DependencyOrder(config.Services)
+
 	return config, nil
 }
 
@@ -93,22 +106,518 @@ func LoadConfig(filename string) (*Config, error) {
 type Config struct {
 	types.Config
 	Services []Service
+	Redeploy Redeploy
 }
 
 // Service represents a Service in a Docker Compose v3 file.
 type Service types.ServiceConfig
 
+// Strategy describes how the container of a service is replaced.
+type Strategy string
+
+const (
+	// StopFirst stops the old container before
+	// creating and starting the new one.
+	StopFirst Strategy = "stop-first"
+	// StartFirst starts the new container and waits for it
+	// to become healthy before the old one is stopped.
+	StartFirst Strategy = "start-first"
+)
+
+// FailureAction describes what is done when a replica
+// of a service fails to update.
+type FailureAction string
+
+const (
+	// FailurePause stops updating further replicas.
+	FailurePause FailureAction = "pause"
+	// FailureContinue updates the remaining replicas anyway.
+	FailureContinue FailureAction = "continue"
+	// FailureRollback stops updating further replicas, and rolls
+	// back the replicas already updated to their previous image.
+	FailureRollback FailureAction = "rollback"
+)
+
+// DriftPolicy describes what is done when the container
+// of a service drifts from the configuration of the service.
+type DriftPolicy string
+
+const (
+	// DriftIgnore ignores drift.
+	DriftIgnore DriftPolicy = "ignore"
+	// DriftReport logs drift and reports it
+	// in the status of the service.
+	DriftReport DriftPolicy = "report"
+	// DriftRepair also redeploys the service.
+	DriftRepair DriftPolicy = "repair"
+)
+
+// Labels used to configure how redeploy treats a service.
+const (
+	// PollLabel is used to opt a service out of
+	// registry polling, by setting it to "false".
+	PollLabel = "redeploy.poll"
+	// TagPolicyLabel configures the tags of the image
+	// repository a service follows, see policy.Parse.
+	TagPolicyLabel = "redeploy.tag-policy"
+	// DriftLabel configures the DriftPolicy of a service.
+	DriftLabel = "redeploy.drift"
+	// RestartDependentsLabel is used to opt a service in to
+	// restarting the services depending on it after it is
+	// deployed, by setting it to "true".
+	RestartDependentsLabel = "redeploy.restart-dependents"
+	// RangePortsLabel is used to let the replicas of a service
+	// publish its ports, by setting it to "true". Each replica
+	// publishes the ports on the published port plus its index
+	// minus one, e.g. 8080, 8081 and 8082 for three replicas.
+	RangePortsLabel = "redeploy.range-ports"
+	// EnvLabel configures the environment variable an
+	// external secret or config is read from.
+	EnvLabel = "redeploy.env"
+)
+
 // Validate checks all required parameters are defined.
 func (c *Config) Validate() error {
+	for name, network := range c.Networks {
+		if network.Attachable && !network.External.External {
+			// Attachable networks are created in swarm mode
+			return fmt.Errorf("network %s: attachable networks must be created with docker network create --attachable and declared external", name)
+		}
+	}
+
+	for name, secret := range c.Secrets {
+		if err := validateFile("secret", name, types.FileObjectConfig(secret)); err != nil {
+			return err
+		}
+	}
+	for name, conf := range c.Configs {
+		if err := validateFile("config", name, types.FileObjectConfig(conf)); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool, len(c.Services))
+	for _, service := range c.Services {
+		names[service.Name] = true
+	}
+	for _, service := range c.Services {
+		for _, dep := range service.DependsOn {
+			if !names[dep] {
+				return fmt.Errorf("%s: undefined dependency %s", service.Name, dep)
+			}
+		}
+	}
+	if _, err := DependencyOrder(c.Services); err != nil {
+		return err
+	}
+
 	for _, service := range c.Services {
 		if service.Image == "" {
 			return fmt.Errorf("%s: image is required", service.Name)
 		}
+
+		for _, vol := range service.Volumes {
+			switch vol.Consistency {
+			case "", "default", "consistent", "cached", "delegated":
+			default:
+				return fmt.Errorf("%s: invalid consistency %q for volume %s", service.Name, vol.Consistency, vol.Target)
+			}
+		}
+
+		for _, secret := range service.Secrets {
+			if _, ok := c.Secrets[secret.Source]; !ok {
+				return fmt.Errorf("%s: undefined secret %s", service.Name, secret.Source)
+			}
+			if err := validateReference("secret", types.FileReferenceConfig(secret)); err != nil {
+				return fmt.Errorf("%s: %v", service.Name, err)
+			}
+		}
+		for _, conf := range service.Configs {
+			if _, ok := c.Configs[conf.Source]; !ok {
+				return fmt.Errorf("%s: undefined config %s", service.Name, conf.Source)
+			}
+			if err := validateReference("config", types.FileReferenceConfig(conf)); err != nil {
+				return fmt.Errorf("%s: %v", service.Name, err)
+			}
+		}
+
+		switch service.Strategy() {
+		case StopFirst:
+		case StartFirst:
+			if len(service.Ports) > 0 {
+				return fmt.Errorf("%s: update order %q cannot be used with published ports", service.Name, StartFirst)
+			}
+		default:
+			return fmt.Errorf("%s: invalid update order %q", service.Name, service.Strategy())
+		}
+
+		switch service.FailureAction() {
+		case FailurePause, FailureContinue, FailureRollback:
+		default:
+			return fmt.Errorf("%s: invalid update failure action %q", service.Name, service.FailureAction())
+		}
+
+		if service.Replicas() > 1 && !service.rangePorts() {
+			for _, port := range service.Ports {
+				if port.Published != 0 {
+					return fmt.Errorf("%s: published ports cannot be used with %d replicas without label %s", service.Name, service.Replicas(), RangePortsLabel)
+				}
+			}
+		}
+		if service.Deploy.Replicas != nil {
+			for _, other := range c.Services {
+				if _, ok := service.ReplicaIndex(other.Name); ok && other.Name != service.Name {
+					return fmt.Errorf("%s: name conflicts with the replicas of service %s", other.Name, service.Name)
+				}
+			}
+		}
+
+		for _, label := range []string{PollLabel, RestartDependentsLabel, RangePortsLabel} {
+			if v, ok := service.Labels[label]; ok {
+				if _, err := strconv.ParseBool(v); err != nil {
+					return fmt.Errorf("%s: invalid value %q for label %s", service.Name, v, label)
+				}
+			}
+		}
+
+		switch service.DriftPolicy() {
+		case DriftIgnore, DriftReport, DriftRepair:
+		default:
+			return fmt.Errorf("%s: invalid value %q for label %s", service.Name, service.DriftPolicy(), DriftLabel)
+		}
+
+		if _, ok := service.Labels[TagPolicyLabel]; ok {
+			if strings.Contains(service.Image, "@") {
+				return fmt.Errorf("%s: label %s cannot be used with an image digest", service.Name, TagPolicyLabel)
+			}
+			if _, err := service.TagPolicy(); err != nil {
+				return fmt.Errorf("%s: %v", service.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateFile checks that a secret or config is read from either
+// a file or, if it is external, an environment variable.
+func validateFile(kind, name string, f types.FileObjectConfig) error {
+	_, env := f.Labels[EnvLabel]
+	switch {
+	case !f.External.External && env:
+		// The loader defaults the file to the directory of the configuration
+		return fmt.Errorf("%s %s: label %s can only be used with external: true", kind, name, EnvLabel)
+	case f.External.External && !env:
+		// Otherwise external secrets and configs are swarm objects
+		return fmt.Errorf("%s %s: external %ss require label %s", kind, name, kind, EnvLabel)
 	}
+	return nil
+}
 
+// validateReference checks the owner of a secret or config of a service.
+func validateReference(kind string, ref types.FileReferenceConfig) error {
+	for _, id := range []string{ref.UID, ref.GID} {
+		if id == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+			return fmt.Errorf("%s %s: invalid uid or gid %q", kind, ref.Source, id)
+		}
+	}
 	return nil
 }
 
+// Strategy returns the strategy used to replace the container
+// of the service, as configured in deploy.update_config.order.
+// Defaults to StopFirst.
+func (s Service) Strategy() Strategy {
+	if s.Deploy.UpdateConfig == nil || s.Deploy.UpdateConfig.Order == "" {
+		return StopFirst
+	}
+	return Strategy(s.Deploy.UpdateConfig.Order)
+}
+
+// FailureAction returns what is done when a replica of the service
+// fails to update, as configured in deploy.update_config.failure_action.
+// Defaults to FailurePause.
+func (s Service) FailureAction() FailureAction {
+	if s.Deploy.UpdateConfig == nil || s.Deploy.UpdateConfig.FailureAction == "" {
+		return FailurePause
+	}
+	return FailureAction(s.Deploy.UpdateConfig.FailureAction)
+}
+
+// Parallelism returns the number of replicas of the service updated
+// at once, as configured in deploy.update_config.parallelism.
+// Defaults to 1, and 0 updates all replicas at once.
+func (s Service) Parallelism() int {
+	if s.Deploy.UpdateConfig == nil || s.Deploy.UpdateConfig.Parallelism == nil {
+		return 1
+	}
+	return int(*s.Deploy.UpdateConfig.Parallelism)
+}
+
+// UpdateDelay returns the time waited between updating batches of
+// replicas, as configured in deploy.update_config.delay.
+func (s Service) UpdateDelay() time.Duration {
+	if s.Deploy.UpdateConfig == nil {
+		return 0
+	}
+	return s.Deploy.UpdateConfig.Delay
+}
+
+// Replicas returns the number of containers of the service,
+// as configured in deploy.replicas. Defaults to 1.
+func (s Service) Replicas() int {
+	if s.Deploy.Replicas == nil {
+		return 1
+	}
+	return int(*s.Deploy.Replicas)
+}
+
+// ContainerNames returns the names of the containers of the service.
+// Services that configure deploy.replicas have containers named
+// <service>_1 to <service>_N, others a single container named
+// after the service.
+func (s Service) ContainerNames() []string {
+	if s.Deploy.Replicas == nil {
+		return []string{s.Name}
+	}
+	names := make([]string, 0, s.Replicas())
+	for i := 1; i <= s.Replicas(); i++ {
+		names = append(names, s.Name+"_"+strconv.Itoa(i))
+	}
+	return names
+}
+
+// ReplicaIndex returns the index, starting at 1, of the replica of
+// the service the container with the provided name is named as,
+// or false if it isn't named like a replica of the service. Names
+// are matched regardless of the number of replicas, so that
+// containers left behind by scaling down are found. Containers
+// named after the service are its first replica.
+func (s Service) ReplicaIndex(name string) (int, bool) {
+	if name == s.Name {
+		return 1, true
+	}
+	if !strings.HasPrefix(name, s.Name+"_") {
+		return 0, false
+	}
+	suffix := strings.TrimPrefix(name, s.Name+"_")
+	i, err := strconv.Atoi(suffix)
+	if err != nil || i < 1 || strconv.Itoa(i) != suffix {
+		return 0, false
+	}
+	return i, true
+}
+
+func (s Service) rangePorts() bool {
+	rangePorts, _ := strconv.ParseBool(s.Labels[RangePortsLabel])
+	return rangePorts
+}
+
+// ReplicaContainerOptions returns the options for creating the
+// container of the replica of the service with the provided index,
+// starting at 1, named as returned by ContainerNames. With the
+// redeploy.range-ports label, the published ports are offset by
+// the index minus one.
+func (s Service) ReplicaContainerOptions(replica int) (docker.CreateContainerOptions, error) {
+	c, err := s.CreateContainerOptions()
+	if err != nil {
+		return c, err
+	}
+	if s.Deploy.Replicas != nil {
+		c.Name = s.Name + "_" + strconv.Itoa(replica)
+	}
+	if replica == 1 || !s.rangePorts() {
+		return c, nil
+	}
+
+	c.Config.PortSpecs = nil
+	for inside, bindings := range c.HostConfig.PortBindings {
+		for i, binding := range bindings {
+			port, err := strconv.Atoi(binding.HostPort)
+			if err != nil || port == 0 {
+				// Ports that aren't published are random anyway
+				continue
+			}
+			bindings[i].HostPort = strconv.Itoa(port + replica - 1)
+		}
+		for _, binding := range bindings {
+			c.Config.PortSpecs = append(c.Config.PortSpecs, binding.HostPort+":"+string(inside))
+		}
+	}
+	sort.Strings(c.Config.PortSpecs)
+	return c, nil
+}
+
+// Poll returns whether the registry should be polled for
+// changes to the image of the service. Services opt out by
+// setting the redeploy.poll label to false.
+func (s Service) Poll() bool {
+	poll, err := strconv.ParseBool(s.Labels[PollLabel])
+	return err != nil || poll
+}
+
+// RestartDependents returns whether the services depending
+// on the service are restarted after it is deployed, as
+// configured with the redeploy.restart-dependents label.
+func (s Service) RestartDependents() bool {
+	restart, _ := strconv.ParseBool(s.Labels[RestartDependentsLabel])
+	return restart
+}
+
+// DependencyOrder returns the services ordered such that every
+// service comes after the services it depends on, and otherwise
+// in the order provided. Dependencies on services that aren't
+// provided are ignored. An error is returned if the dependencies
+// form a cycle.
+func DependencyOrder(services []Service) ([]Service, error) {
+	pending := make(map[string]bool, len(services))
+	for _, service := range services {
+		pending[service.Name] = true
+	}
+
+	ordered := make([]Service, 0, len(services))
+	for len(ordered) < len(services) {
+		progress := false
+		for _, service := range services {
+			if !pending[service.Name] || waiting(service, pending) {
+				continue
+			}
+			ordered = append(ordered, service)
+			delete(pending, service.Name)
+			progress = true
+			// Start over, so services keep their order where possible
+			break
+		}
+		if !progress {
+			return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle(services, pending), " -> "))
+		}
+	}
+	return ordered, nil
+}
+
+// waiting returns whether the service depends on a pending service.
+func waiting(service Service, pending map[string]bool) bool {
+	for _, dep := range service.DependsOn {
+		if pending[dep] {
+			return true
+		}
+	}
+	return false
+}
+
+// cycle returns a dependency cycle among the pending services,
+// which are all waiting for another pending service.
+func cycle(services []Service, pending map[string]bool) []string {
+	byName := make(map[string]Service, len(services))
+	var start string
+	for _, service := range services {
+		byName[service.Name] = service
+		if start == "" && pending[service.Name] {
+			start = service.Name
+		}
+	}
+
+	seen := map[string]int{}
+	var path []string
+	for name := start; ; {
+		if i, ok := seen[name]; ok {
+			return append(path[i:], name)
+		}
+		seen[name] = len(path)
+		path = append(path, name)
+		for _, dep := range byName[name].DependsOn {
+			if pending[dep] {
+				name = dep
+				break
+			}
+		}
+	}
+}
+
+// DriftPolicy returns what is done when the container of the
+// service drifts from its configuration, as configured with
+// the redeploy.drift label. Defaults to DriftReport.
+func (s Service) DriftPolicy() DriftPolicy {
+	v, ok := s.Labels[DriftLabel]
+	if !ok {
+		return DriftReport
+	}
+	return DriftPolicy(v)
+}
+
+// TagPolicy returns the tag policy of the service, as configured
+// with the redeploy.tag-policy label. If the label is not set,
+// nil is returned and the service follows the tag of its image.
+func (s Service) TagPolicy() (policy.Policy, error) {
+	v, ok := s.Labels[TagPolicyLabel]
+	if !ok {
+		return nil, nil
+	}
+	return policy.Parse(v)
+}
+
+// PrimaryNetwork returns the network the container of the service
+// is created in, which is the first of its networks by name, or
+// an empty string if the service has no networks.
+func (s Service) PrimaryNetwork() string {
+	var primary string
+	for name := range s.Networks {
+		if primary == "" || name < primary {
+			primary = name
+		}
+	}
+	return primary
+}
+
+// NetworkEndpoints returns the endpoint configuration
+// of each network of the service, by network.
+func (s Service) NetworkEndpoints() map[string]*docker.EndpointConfig {
+	endpoints := make(map[string]*docker.EndpointConfig, len(s.Networks))
+	for name, network := range s.Networks {
+		endpoint := &docker.EndpointConfig{}
+		if network != nil {
+			endpoint.Aliases = network.Aliases
+			if network.Ipv4Address != "" || network.Ipv6Address != "" {
+				endpoint.IPAMConfig = &docker.EndpointIPAMConfig{
+					IPv4Address: network.Ipv4Address,
+					IPv6Address: network.Ipv6Address,
+				}
+			}
+		}
+		endpoints[name] = endpoint
+	}
+	return endpoints
+}
+
+// hasConsistency returns whether the volume is a bind mount or
+// named volume with another than the default consistency.
+func hasConsistency(vol types.ServiceVolumeConfig) bool {
+	switch vol.Consistency {
+	case "", "default":
+		return false
+	}
+	return vol.Type == "bind" || vol.Type == "volume" && vol.Source != ""
+}
+
+// bindSpec returns the volume in the source:target:options format
+// of binds, e.g. "certs:/certs:ro,cached".
+func bindSpec(vol types.ServiceVolumeConfig) string {
+	opts := []string{vol.Consistency}
+	if vol.ReadOnly {
+		opts = append([]string{"ro"}, opts...)
+	}
+	if vol.Bind != nil && vol.Bind.Propagation != "" {
+		opts = append(opts, vol.Bind.Propagation)
+	}
+	if vol.Volume != nil && vol.Volume.NoCopy {
+		opts = append(opts, "nocopy")
+	}
+	return vol.Source + ":" + vol.Target + ":" + strings.Join(opts, ",")
+}
+
 // CreateContainerOptions translates the Service configuration to an fsouza/go-dockerclient
 // CreateContainerOptions type.
 func (s Service) CreateContainerOptions() (docker.CreateContainerOptions, error) {
@@ -152,16 +661,16 @@ func (s Service) CreateContainerOptions() (docker.CreateContainerOptions, error)
 		},
 	}
 
-	if len(s.Networks) > 0 {
+	if primary := s.PrimaryNetwork(); primary != "" {
+		// Docker only connects a container to one network on create,
+		// the others have to be connected before it is started.
 		c.NetworkingConfig = &docker.NetworkingConfig{
-			EndpointsConfig: map[string]*docker.EndpointConfig{},
+			EndpointsConfig: map[string]*docker.EndpointConfig{
+				primary: s.NetworkEndpoints()[primary],
+			},
 		}
-		for name, network := range s.Networks {
-			c.NetworkingConfig.EndpointsConfig[name] = &docker.EndpointConfig{
-				Aliases:           network.Aliases,
-				IPAddress:         network.Ipv4Address,
-				GlobalIPv6Address: network.Ipv6Address,
-			}
+		if c.HostConfig.NetworkMode == "" {
+			c.HostConfig.NetworkMode = primary
 		}
 	}
 
@@ -218,6 +727,12 @@ func (s Service) CreateContainerOptions() (docker.CreateContainerOptions, error)
 
 	if len(s.Volumes) > 0 {
 		for _, vol := range s.Volumes {
+			if hasConsistency(vol) {
+				// Mounts don't support consistency, binds do
+				c.HostConfig.Binds = append(c.HostConfig.Binds, bindSpec(vol))
+				continue
+			}
+
 			hm := docker.HostMount{
 				Source:   vol.Source,
 				Target:   vol.Target,
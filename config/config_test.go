@@ -1,8 +1,11 @@
 package config_test
 
 import (
+	"fmt"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 
@@ -176,6 +179,43 @@ func TestLoader(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:      "StartFirst",
+			InputFile: "./testdata/start-first.yaml",
+			Expected: &config.Config{
+				Config: types.Config{
+					Version:  "3.4",
+					Filename: "./testdata/start-first.yaml",
+					Networks: map[string]types.NetworkConfig{},
+					Volumes:  map[string]types.VolumeConfig{},
+					Secrets:  map[string]types.SecretConfig{},
+					Configs:  map[string]types.ConfigObjConfig{},
+				},
+				Services: []config.Service{
+					{
+						Name:        "test",
+						Image:       "test/test1",
+						Environment: types.MappingWithEquals{},
+						Deploy: types.DeployConfig{
+							UpdateConfig: &types.UpdateConfig{
+								Order: "start-first",
+							},
+						},
+					},
+				},
+			},
+			ContainerConfigs: []docker.CreateContainerOptions{{
+				Name: "test",
+				Config: &docker.Config{
+					Image:        "test/test1",
+					AttachStderr: true,
+					AttachStdout: true,
+				},
+				HostConfig: &docker.HostConfig{
+					PublishAllPorts: true,
+				},
+			}},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -204,3 +244,364 @@ func TestLoader(t *testing.T) {
 		}
 	}
 }
+
+func TestInvalidConfig(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		InputFile string
+		Error     string
+	}{
+		{
+			Name:      "UnknownRedeployKey",
+			InputFile: "./testdata/redeploy-unknown.yaml",
+			Error:     "x-redeploy: 1 error(s) decoding:\n\n* '' has invalid keys: registry",
+		},
+		{
+			Name:      "DuplicateWebhookPath",
+			InputFile: "./testdata/webhook-duplicate.yaml",
+			Error:     "x-redeploy: webhook /gitlab: duplicate path",
+		},
+		{
+			Name:      "ReservedWebhookPath",
+			InputFile: "./testdata/webhook-reserved.yaml",
+			Error:     "x-redeploy: webhook /jobs/gitlab: path conflicts with built-in endpoint /jobs/",
+		},
+		{
+			Name:      "GenericWebhookWithoutRepository",
+			InputFile: "./testdata/webhook-generic.yaml",
+			Error:     "x-redeploy: webhook /ci: missing repository expression",
+		},
+		{
+			Name:      "InvalidPollLabel",
+			InputFile: "./testdata/poll-invalid.yaml",
+			Error:     `test: invalid value "sometimes" for label redeploy.poll`,
+		},
+		{
+			Name:      "InvalidDriftLabel",
+			InputFile: "./testdata/drift-invalid.yaml",
+			Error:     `test: invalid value "fix" for label redeploy.drift`,
+		},
+		{
+			Name:      "InvalidTagPolicy",
+			InputFile: "./testdata/tag-policy-invalid.yaml",
+			Error:     `test: invalid tag policy "semver:~1.x.x.x": invalid version "1.x.x.x"`,
+		},
+		{
+			Name:      "AttachableNetwork",
+			InputFile: "./testdata/network-attachable.yaml",
+			Error:     `network backend: attachable networks must be created with docker network create --attachable and declared external`,
+		},
+		{
+			Name:      "InvalidConsistency",
+			InputFile: "./testdata/volume-consistency.yaml",
+			Error:     `test: invalid consistency "sometimes" for volume /src`,
+		},
+		{
+			Name:      "UndefinedSecret",
+			InputFile: "./testdata/secret-undefined.yaml",
+			Error:     `test: undefined secret api_key`,
+		},
+		{
+			Name:      "ExternalSecret",
+			InputFile: "./testdata/secret-external.yaml",
+			Error:     `secret api_key: external secrets require label redeploy.env`,
+		},
+		{
+			Name:      "SecretEnvWithoutExternal",
+			InputFile: "./testdata/secret-env.yaml",
+			Error:     `secret api_key: label redeploy.env can only be used with external: true`,
+		},
+		{
+			Name:      "InvalidConfigUID",
+			InputFile: "./testdata/config-uid.yaml",
+			Error:     `test: config app_conf: invalid uid or gid "root"`,
+		},
+		{
+			Name:      "UndefinedDependency",
+			InputFile: "./testdata/depends-undefined.yaml",
+			Error:     `app: undefined dependency db`,
+		},
+		{
+			Name:      "DependencyCycle",
+			InputFile: "./testdata/depends-cycle.yaml",
+			Error:     `dependency cycle: app -> worker -> db -> app`,
+		},
+		{
+			Name:      "InvalidRestartDependentsLabel",
+			InputFile: "./testdata/restart-dependents-invalid.yaml",
+			Error:     `test: invalid value "always" for label redeploy.restart-dependents`,
+		},
+		{
+			Name:      "ReplicasWithPorts",
+			InputFile: "./testdata/replicas-ports.yaml",
+			Error:     `web: published ports cannot be used with 2 replicas without label redeploy.range-ports`,
+		},
+		{
+			Name:      "ReplicaNameConflict",
+			InputFile: "./testdata/replicas-conflict.yaml",
+			Error:     `web_1: name conflicts with the replicas of service web`,
+		},
+		{
+			Name:      "InvalidFailureAction",
+			InputFile: "./testdata/failure-action-invalid.yaml",
+			Error:     `web: invalid update failure action "retry"`,
+		},
+		{
+			Name:      "StartFirstWithPorts",
+			InputFile: "./testdata/start-first-ports.yaml",
+			Error:     `test: update order "start-first" cannot be used with published ports`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := config.LoadConfig(testCase.InputFile)
+		if err == nil {
+			t.Errorf("For %s: expected error", testCase.Name)
+			continue
+		}
+		if err.Error() != testCase.Error {
+			t.Errorf("For %s: got error %q, expected %q", testCase.Name, err.Error(), testCase.Error)
+		}
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	c, err := config.LoadConfig("./testdata/networks.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := c.Services[0]
+
+	endpoints := map[string]*docker.EndpointConfig{
+		"backend": {
+			IPAMConfig: &docker.EndpointIPAMConfig{
+				IPv4Address: "172.28.0.10",
+			},
+		},
+		"frontend": {
+			Aliases: []string{"web"},
+		},
+	}
+	if diff := deep.Equal(service.NetworkEndpoints(), endpoints); diff != nil {
+		t.Error(diff)
+	}
+
+	// Containers are created in the first network only
+	opts, err := service.CreateContainerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.HostConfig.NetworkMode != "backend" {
+		t.Errorf("Got network mode %q, expected %q", opts.HostConfig.NetworkMode, "backend")
+	}
+	expected := &docker.NetworkingConfig{
+		EndpointsConfig: map[string]*docker.EndpointConfig{
+			"backend": endpoints["backend"],
+		},
+	}
+	if diff := deep.Equal(opts.NetworkingConfig, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	// Networks that aren't declared are existing Docker networks
+	c, err = config.LoadConfig("./testdata/network-undeclared.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err = c.Services[0].CreateContainerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.HostConfig.NetworkMode != "proxy" {
+		t.Errorf("Got network mode %q, expected %q", opts.HostConfig.NetworkMode, "proxy")
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	c, err := config.LoadConfig("./testdata/volumes.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]types.VolumeConfig{
+		"data": {
+			Name:   "app-data",
+			Driver: "local",
+			DriverOpts: map[string]string{
+				"type":   "tmpfs",
+				"device": "tmpfs",
+			},
+			Labels: types.Labels{"app": "test"},
+		},
+		"cache": {
+			Name:     "cache",
+			External: types.External{External: true},
+		},
+	}
+	if diff := deep.Equal(c.Volumes, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	// Volumes with a consistency are bound, as mounts
+	// don't support it
+	opts, err := c.Services[0].CreateContainerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts := []docker.HostMount{{
+		Source: "data",
+		Target: "/data",
+		Type:   "volume",
+	}}
+	if diff := deep.Equal(opts.HostConfig.Mounts, mounts); diff != nil {
+		t.Error(diff)
+	}
+	binds := []string{
+		"cache:/cache:ro,cached",
+		"/srv/src:/src:delegated",
+	}
+	if diff := deep.Equal(opts.HostConfig.Binds, binds); diff != nil {
+		t.Error(diff)
+	}
+
+	// Volumes that aren't declared are left to Docker to create
+	c, err = config.LoadConfig("./testdata/volume-undeclared.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err = c.Services[0].CreateContainerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(opts.HostConfig.Mounts, mounts); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	c, err := config.LoadConfig("./testdata/depends.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Services come after their dependencies, and otherwise by name
+	var names []string
+	for _, service := range c.Services {
+		names = append(names, service.Name)
+	}
+	if diff := deep.Equal(names, []string{"admin", "cache", "db", "app", "worker"}); diff != nil {
+		t.Error(diff)
+	}
+
+	for _, service := range c.Services {
+		if service.RestartDependents() != (service.Name == "app") {
+			t.Errorf("Got RestartDependents() %t for %s", service.RestartDependents(), service.Name)
+		}
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	c, err := config.LoadConfig("./testdata/replicas.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := c.Services[0]
+
+	if diff := deep.Equal(service.ContainerNames(), []string{"web_1", "web_2", "web_3"}); diff != nil {
+		t.Error(diff)
+	}
+	if service.Parallelism() != 2 || service.UpdateDelay() != 10*time.Second || service.FailureAction() != config.FailureRollback {
+		t.Errorf("Unexpected update config: %+v", service.Deploy.UpdateConfig)
+	}
+
+	for name, expected := range map[string]int{
+		"web":     1,
+		"web_1":   1,
+		"web_12":  12,
+		"web_0":   0,
+		"web_01":  0,
+		"web_x":   0,
+		"web2_1":  0,
+		"other_1": 0,
+	} {
+		i, ok := service.ReplicaIndex(name)
+		if ok != (expected > 0) || i != expected {
+			t.Errorf("Got ReplicaIndex(%q) %d, %t, expected %d", name, i, ok, expected)
+		}
+	}
+
+	// Replicas publish ports in a range
+	opts, err := service.ReplicaContainerOptions(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Name != "web_3" {
+		t.Errorf("Got name %q, expected %q", opts.Name, "web_3")
+	}
+	bindings := map[docker.Port][]docker.PortBinding{
+		"80/tcp": {{HostPort: "8082"}},
+	}
+	if diff := deep.Equal(opts.HostConfig.PortBindings, bindings); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(opts.Config.PortSpecs, []string{"8082:80/tcp"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestRedeploySection(t *testing.T) {
+	for k, v := range map[string]string{
+		"TEST_REGISTRY_PASSWORD":   "secret",
+		config.RegistryUsernameEnv: "someone",
+		config.RegistryPasswordEnv: "hunter2",
+	} {
+		err := os.Setenv(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Unsetenv(k)
+	}
+
+	c, err := config.LoadConfig("./testdata/registries.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := config.Redeploy{
+		Registries: map[string]config.RegistryAuth{
+			"registry.example.com": {
+				Username: "bot",
+				Password: "secret",
+			},
+			config.DockerHub: {
+				Username: "someone",
+				Password: "hunter2",
+			},
+		},
+		Webhooks: []config.Webhook{
+			{
+				Path:   "/gitlab",
+				Format: "gitlab",
+				Token:  "secret",
+			},
+			{
+				Path:   "/quay",
+				Format: "quay",
+			},
+			{
+				Path:       "/ci",
+				Format:     "generic",
+				Token:      "secret",
+				Repository: "$.image",
+				Tag:        "{{ .tag }}",
+			},
+		},
+	}
+	if diff := deep.Equal(c.Redeploy, expected); diff != nil {
+		t.Error(strings.Join(diff, "\n"))
+	}
+
+	if s := fmt.Sprintf("%v %+v %#v", c.Redeploy, c.Redeploy, c.Redeploy); strings.Contains(s, "secret") || strings.Contains(s, "hunter2") {
+		t.Errorf("Password included in formatted configuration: %s", s)
+	}
+}
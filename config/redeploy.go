@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/interpolation"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// redeployKey is the top level key of the redeploy specific
+// configuration. Docker Compose ignores keys prefixed with x-.
+const redeployKey = "x-redeploy"
+
+// DockerHub is the registry host of Docker Hub.
+const DockerHub = "docker.io"
+
+// Environment variables configuring the credentials for a registry,
+// in addition to those in the configuration file. The registry
+// defaults to Docker Hub.
+const (
+	RegistryEnv         = "REDEPLOY_REGISTRY"
+	RegistryUsernameEnv = "REDEPLOY_REGISTRY_USERNAME"
+	RegistryPasswordEnv = "REDEPLOY_REGISTRY_PASSWORD"
+)
+
+// Redeploy is the configuration specific to redeploy,
+// read from the top level x-redeploy section.
+type Redeploy struct {
+	// Registries maps registry hosts to the
+	// credentials to use when pulling from them.
+	Registries map[string]RegistryAuth `mapstructure:"registries"`
+	// Webhooks are additional webhook endpoints
+	// accepting the formats of other registries.
+	Webhooks []Webhook `mapstructure:"webhooks"`
+}
+
+// RegistryAuth is the credentials for a registry.
+type RegistryAuth struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// String returns a description of the credentials
+// that does not include the password.
+func (r RegistryAuth) String() string {
+	return fmt.Sprintf("{Username:%s Password:<redacted>}", r.Username)
+}
+
+// GoString is like String, for use with %#v.
+func (r RegistryAuth) GoString() string {
+	return r.String()
+}
+
+// Webhook is a webhook endpoint for pushes to a registry
+// or from a CI system, in the format of the sender.
+type Webhook struct {
+	// Path is the path the webhook is served on. A leading
+	// slash is added if it is missing.
+	Path string `mapstructure:"path"`
+	// Format is the format of the requests, such as gitlab.
+	Format string `mapstructure:"format"`
+	// Token is the secret the sender authenticates with.
+	Token string `mapstructure:"token"`
+	// Repository, Tag and Digest are the expressions extracting
+	// the pushed image from requests in the generic format.
+	Repository string `mapstructure:"repository"`
+	Tag        string `mapstructure:"tag"`
+	Digest     string `mapstructure:"digest"`
+}
+
+// String returns a description of the webhook
+// that does not include the token.
+func (w Webhook) String() string {
+	return fmt.Sprintf("{Path:%s Format:%s Token:<redacted>}", w.Path, w.Format)
+}
+
+// GoString is like String, for use with %#v.
+func (w Webhook) GoString() string {
+	return w.String()
+}
+
+// reservedPaths are the paths of the endpoints built into redeploy,
+// which webhooks can't be served on. Paths ending in a slash are
+// reserved along with all paths below them.
+var reservedPaths = []string{"/jobs/", "/services", "/services/", "/history"}
+
+// reservedPath returns the reserved path the path
+// conflicts with, or false if there is none.
+func reservedPath(path string) (string, bool) {
+	for _, p := range reservedPaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// loadRedeploy removes the redeploy section from the
+// configuration data and parses it. Variables in the
+// section are substituted from the environment.
+func loadRedeploy(data map[string]interface{}, env map[string]string) (Redeploy, error) {
+	var r Redeploy
+
+	section, ok := data[redeployKey]
+	delete(data, redeployKey)
+	if ok {
+		interpolated, err := interpolation.Interpolate(map[string]interface{}{
+			redeployKey: section,
+		}, interpolation.Options{
+			LookupValue: func(key string) (string, bool) {
+				v, ok := env[key]
+				return v, ok
+			},
+		})
+		if err != nil {
+			return r, err
+		}
+
+		dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			ErrorUnused: true,
+			Result:      &r,
+		})
+		if err != nil {
+			return r, err
+		}
+		err = dec.Decode(interpolated[redeployKey])
+		if err != nil {
+			return r, errors.Wrap(err, redeployKey)
+		}
+	}
+
+	paths := map[string]bool{}
+	for i, w := range r.Webhooks {
+		if w.Path == "" {
+			return r, errors.Errorf("%s: webhook %d: missing path", redeployKey, i)
+		}
+		w.Path = "/" + strings.TrimPrefix(w.Path, "/")
+		r.Webhooks[i].Path = w.Path
+		if reserved, ok := reservedPath(w.Path); ok {
+			return r, errors.Errorf("%s: webhook %s: path conflicts with built-in endpoint %s", redeployKey, w.Path, reserved)
+		}
+		switch {
+		case w.Format == "":
+			return r, errors.Errorf("%s: webhook %s: missing format", redeployKey, w.Path)
+		case paths[w.Path]:
+			return r, errors.Errorf("%s: webhook %s: duplicate path", redeployKey, w.Path)
+		case w.Format == "generic" && w.Repository == "":
+			return r, errors.Errorf("%s: webhook %s: missing repository expression", redeployKey, w.Path)
+		case w.Format != "generic" && (w.Repository != "" || w.Tag != "" || w.Digest != ""):
+			return r, errors.Errorf("%s: webhook %s: expressions are only supported by the generic format", redeployKey, w.Path)
+		}
+		paths[w.Path] = true
+	}
+
+	if username := env[RegistryUsernameEnv]; username != "" {
+		registry := env[RegistryEnv]
+		if registry == "" {
+			registry = DockerHub
+		}
+		if r.Registries == nil {
+			r.Registries = map[string]RegistryAuth{}
+		}
+		r.Registries[registry] = RegistryAuth{
+			Username: username,
+			Password: env[RegistryPasswordEnv],
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,412 @@
+package deploy
+
+import (
+	"context"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// Labels redeploy sets on the containers it creates.
+const (
+	// DigestLabel is the repository digest of the
+	// image the container was created from.
+	DigestLabel = "redeploy.digest"
+	// ImageLabel is the image reference, including
+	// the tag, that the container was deployed for.
+	ImageLabel = "redeploy.image"
+	// ServiceLabel is the name of the service
+	// the container was created for.
+	ServiceLabel = "redeploy.service"
+	// PinnedLabel is set on containers created by a rollback
+	// to another image than the one configured, which drift
+	// detection and reconciliation keep.
+	PinnedLabel = "redeploy.pinned"
+)
+
+// Suffixes used for the names of containers while they are
+// being swapped during a start-first replacement.
+const (
+	nextSuffix = "-redeploy-next"
+	prevSuffix = "-redeploy-prev"
+)
+
+// replace replaces the existing containers of the service, if any,
+// with new ones, according to the strategy of the service. Surplus
+// containers are removed first, and replicas are then replaced
+// as configured in the update config of the service.
+func (d *Deployer) replace(ctx context.Context, job *Job, service config.Service, logger *logrus.Entry) error {
+	logger = logger.WithField("name", service.Name)
+
+	// Fail before any existing container is touched
+	err := d.prepare(ctx, service, logger)
+	if err != nil {
+		return err
+	}
+
+	d.scaleDown(ctx, service, logger)
+	return d.updateReplicas(ctx, job, service, logger)
+}
+
+// prepare writes the secrets and configs of the service
+// and creates its networks and volumes, which all of its
+// containers, including rolled back ones, are created with.
+func (d *Deployer) prepare(ctx context.Context, service config.Service, logger *logrus.Entry) error {
+	files, err := d.readFiles(service)
+	if err != nil {
+		return err
+	}
+	err = d.writeFiles(service, files, logger)
+	if err != nil {
+		return err
+	}
+	err = d.ensureNetworks(ctx, service, logger)
+	if err != nil {
+		return err
+	}
+	return d.ensureVolumes(ctx, service, logger)
+}
+
+// replaceReplica replaces the existing container of the
+// replica, if any, according to the strategy of the service.
+// The image the old container used is returned.
+func (d *Deployer) replaceReplica(ctx context.Context, job *Job, service config.Service, replica int, logger *logrus.Entry) (previous, error) {
+	if service.Strategy() == config.StartFirst {
+		return d.replaceStartFirst(ctx, job, service, replica, logger)
+	}
+
+	return d.replaceStopFirst(ctx, job, service, replica, logger)
+}
+
+// previous is the image an existing container was created from.
+type previous struct {
+	image  string
+	labels map[string]string
+}
+
+// previousImage returns the image the container was created
+// from, which is empty if it could not be inspected.
+func (d *Deployer) previousImage(ctx context.Context, id string, logger *logrus.Entry) previous {
+	var prev previous
+	if c := d.inspectContainer(ctx, id, logger); c != nil {
+		prev.image = c.Image
+		if c.Config != nil {
+			prev.labels = c.Config.Labels
+		}
+	}
+	return prev
+}
+
+// replaceStopFirst stops and removes any existing container of
+// the replica and creates and starts a new one. If the new container
+// fails, the replica is rolled back to the image the old container used.
+func (d *Deployer) replaceStopFirst(ctx context.Context, job *Job, service config.Service, replica int, logger *logrus.Entry) (previous, error) {
+	cOpts := d.containerOptions(job, service, replica)
+
+	var prev previous
+	id := d.findContainer(ctx, cOpts.Name, logger)
+	if id != "" {
+		prev = d.previousImage(ctx, id, logger)
+		// Container with same name exists, stop and remove it
+		d.stopContainer(ctx, id, logger)
+		d.removeContainer(ctx, id, logger)
+	}
+
+	id, err := d.createAndStart(ctx, service, cOpts, logger)
+	if err == nil {
+		return prev, nil
+	}
+	if prev.image == "" {
+		return prev, err
+	}
+
+	logger.WithError(err).WithField("image", prev.image).Warn("Rolling back to previous image")
+	if id != "" {
+		d.removeContainer(ctx, id, logger)
+	}
+	_ = d.rollback(ctx, job, service, cOpts, prev, logger)
+
+	return prev, err
+}
+
+// rollback creates and starts the container from the previous image.
+func (d *Deployer) rollback(ctx context.Context, job *Job, service config.Service, cOpts docker.CreateContainerOptions, prev previous, logger *logrus.Entry) error {
+	d.setState(job, StateRollingBack)
+	defer d.setState(job, StateReplacing)
+
+	cOpts.Config.Image = prev.image
+	for _, label := range []string{DigestLabel, ImageLabel, PinnedLabel} {
+		if v, ok := prev.labels[label]; ok {
+			cOpts.Config.Labels[label] = v
+		} else {
+			delete(cOpts.Config.Labels, label)
+		}
+	}
+	_, err := d.createAndStart(ctx, service, cOpts, logger)
+	if err != nil {
+		logger.WithError(err).WithField("image", prev.image).Error("Failed to roll back")
+		d.addError(job, service.Name, StateRollingBack, err)
+		return err
+	}
+
+	logger.WithField("image", prev.image).Info("Rolled back to previous image")
+	d.addRollback(job, service.Name, prev.image)
+
+	return nil
+}
+
+// containerOptions returns the options for creating the
+// container of the replica of the service in the job.
+func (d *Deployer) containerOptions(job *Job, service config.Service, replica int) docker.CreateContainerOptions {
+	// Error is checked on startup, can't error now.
+	cOpts, _ := service.ReplicaContainerOptions(replica)
+	idx := d.index()
+	idx.networkOptions(&cOpts)
+	idx.volumeOptions(&cOpts)
+	d.fileOptions(service, &cOpts)
+	if job.image != "" {
+		cOpts.Config.Image = job.image
+	}
+
+	// Don't modify the labels of the service
+	labels := make(map[string]string, len(cOpts.Config.Labels)+4)
+	for k, v := range cOpts.Config.Labels {
+		labels[k] = v
+	}
+	labels[ServiceLabel] = service.Name
+	if job.pinned {
+		labels[PinnedLabel] = "true"
+	}
+	if job.Digest != "" {
+		labels[DigestLabel] = job.Digest
+	}
+	if job.Push.Tag != "" {
+		labels[ImageLabel] = job.Push.Repository + ":" + job.Push.Tag
+	}
+	cOpts.Config.Labels = labels
+
+	return cOpts
+}
+
+// createAndStart creates and starts a container and waits for it to
+// become healthy. If the container was created, its ID is returned.
+func (d *Deployer) createAndStart(ctx context.Context, service config.Service, cOpts docker.CreateContainerOptions, logger *logrus.Entry) (string, error) {
+	cOpts.Context = ctx
+
+	c, err := d.client.CreateContainer(cOpts)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create container")
+	}
+
+	logger.WithField("id", c.ID).Debug("Created container")
+
+	err = d.connectNetworks(ctx, service, c.ID, logger)
+	if err != nil {
+		return c.ID, err
+	}
+
+	d.startMu.Lock()
+	err = d.client.StartContainerWithContext(c.ID, nil, ctx)
+	d.startMu.Unlock()
+	if err != nil {
+		return c.ID, errors.Wrap(err, "failed to start container")
+	}
+
+	logger.WithField("id", c.ID).Debug("Started container")
+
+	return c.ID, d.waitHealthy(ctx, service, c.ID, logger)
+}
+
+// replaceStartFirst creates and starts a new container next to the
+// existing one and waits for it to become healthy. Only then is the
+// old container stopped, the new one renamed to the name of the
+// replica, and the old one removed. If the new container does not
+// become healthy, it is removed and the old one is left running.
+func (d *Deployer) replaceStartFirst(ctx context.Context, job *Job, service config.Service, replica int, logger *logrus.Entry) (previous, error) {
+	cOpts := d.containerOptions(job, service, replica)
+	name := cOpts.Name
+
+	var prev previous
+	oldID := d.findContainer(ctx, name, logger)
+	if oldID != "" {
+		prev = d.previousImage(ctx, oldID, logger)
+	}
+
+	// Clean up after any previously interrupted deploy
+	for _, leftover := range []string{name + nextSuffix, name + prevSuffix} {
+		if id := d.findContainer(ctx, leftover, logger); id != "" {
+			logger.WithField("leftover", leftover).Warn("Removing leftover container")
+			d.removeContainer(ctx, id, logger)
+		}
+	}
+
+	cOpts.Name = name + nextSuffix
+
+	newID, err := d.createAndStart(ctx, service, cOpts, logger)
+	if err != nil {
+		logger.WithError(err).Warn("New container failed, keeping existing container")
+		if newID != "" {
+			d.removeContainer(ctx, newID, logger)
+		}
+		return prev, err
+	}
+
+	if oldID != "" {
+		d.stopContainer(ctx, oldID, logger)
+		err = d.client.RenameContainer(docker.RenameContainerOptions{
+			ID:      oldID,
+			Name:    name + prevSuffix,
+			Context: ctx,
+		})
+		if err != nil {
+			// Without freeing up the name we can't swap the
+			// containers, so restore the old container.
+			d.startContainer(ctx, oldID, logger)
+			d.removeContainer(ctx, newID, logger)
+			return prev, errors.Wrap(err, "failed to rename existing container")
+		}
+	}
+
+	err = d.client.RenameContainer(docker.RenameContainerOptions{
+		ID:      newID,
+		Name:    name,
+		Context: ctx,
+	})
+	if err != nil {
+		// The new container is healthy and serving,
+		// so keep it running under its temporary name.
+		return prev, errors.Wrap(err, "failed to rename new container")
+	}
+
+	logger.Debug("Renamed new container")
+
+	if oldID != "" {
+		d.removeContainer(ctx, oldID, logger)
+	}
+
+	return prev, nil
+}
+
+// findContainer returns the ID of the container with the
+// provided name, or an empty string if there is none.
+func (d *Deployer) findContainer(ctx context.Context, name string, logger *logrus.Entry) string {
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Context: ctx,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to list running containers")
+		// Soldier on anyway
+		return ""
+	}
+
+	logger.Debug("Listed running containers")
+
+	for _, container := range containers {
+		if sliceContains(container.Names, "/"+name) {
+			logger.WithField("id", container.ID).Debug("Found existing container")
+			return container.ID
+		}
+	}
+
+	return ""
+}
+
+// inspectContainer returns the container, or
+// nil if it could not be inspected.
+func (d *Deployer) inspectContainer(ctx context.Context, id string, logger *logrus.Entry) *docker.Container {
+	c, err := d.client.InspectContainerWithContext(id, ctx)
+	if err != nil {
+		logger.WithError(err).WithField("id", id).Error("Failed to inspect existing container")
+		// Soldier on anyway
+		return nil
+	}
+	return c
+}
+
+// runningImage returns the image reference the container of the
+// service was deployed for, or an empty string if there is none.
+func (d *Deployer) runningImage(ctx context.Context, name string, logger *logrus.Entry) string {
+	id := d.findContainer(ctx, name, logger)
+	if id == "" {
+		return ""
+	}
+	c := d.inspectContainer(ctx, id, logger)
+	if c == nil {
+		return ""
+	}
+	if c.Config == nil {
+		return ""
+	}
+	if image, ok := c.Config.Labels[ImageLabel]; ok {
+		// Containers are created from the digest
+		return image
+	}
+	return c.Config.Image
+}
+
+// pinnedImage returns the image reference the container of the
+// service was rolled back to, or an empty string if it wasn't.
+func (d *Deployer) pinnedImage(ctx context.Context, name string, logger *logrus.Entry) string {
+	id := d.findContainer(ctx, name, logger)
+	if id == "" {
+		return ""
+	}
+	c := d.inspectContainer(ctx, id, logger)
+	if c == nil || c.Config == nil || c.Config.Labels[PinnedLabel] != "true" {
+		return ""
+	}
+	if image, ok := c.Config.Labels[ImageLabel]; ok {
+		return image
+	}
+	return c.Config.Image
+}
+
+func (d *Deployer) startContainer(ctx context.Context, id string, logger *logrus.Entry) {
+	d.startMu.Lock()
+	err := d.client.StartContainerWithContext(id, nil, ctx)
+	d.startMu.Unlock()
+	if err != nil {
+		logger.WithError(err).WithField("id", id).Error("Failed to start container")
+		// Soldier on anyway
+	} else {
+		logger.WithField("id", id).Debug("Started container")
+	}
+}
+
+func (d *Deployer) stopContainer(ctx context.Context, id string, logger *logrus.Entry) {
+	err := d.client.StopContainerWithContext(id, 10, ctx)
+	if err != nil {
+		logger.WithError(err).WithField("id", id).Error("Failed to stop running container")
+		// Soldier on anyway
+	} else {
+		logger.WithField("id", id).Debug("Stopped container")
+	}
+}
+
+func (d *Deployer) removeContainer(ctx context.Context, id string, logger *logrus.Entry) {
+	err := d.client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:      id,
+		Force:   true,
+		Context: ctx,
+	})
+	if err != nil {
+		logger.WithError(err).WithField("id", id).Error("Failed to remove container")
+		// Soldier on anyway
+	} else {
+		logger.WithField("id", id).Debug("Deleted container")
+	}
+}
+
+func sliceContains(slice []string, in string) bool {
+	for _, s := range slice {
+		if s == in {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+package deploy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// sortServices sorts the services in dependency order.
+func (idx *serviceIndex) sortServices(services []config.Service) {
+	sort.SliceStable(services, func(i, j int) bool {
+		return idx.rank[services[i].Name] < idx.rank[services[j].Name]
+	})
+}
+
+// dependencyJobs returns the unfinished jobs other than the
+// job that deploy dependencies of its services. Only jobs
+// queued before the job are returned, so jobs never wait
+// for each other. d.mu must be held.
+func (d *Deployer) dependencyJobs(job *Job) []*Job {
+	var after []*Job
+	seen := map[*Job]bool{job: true}
+	for _, service := range job.services {
+		for _, dep := range service.DependsOn {
+			prev := d.latest[dep]
+			if prev == nil || seen[prev] || prev.State.Done() {
+				continue
+			}
+			seen[prev] = true
+			after = append(after, prev)
+		}
+	}
+	return after
+}
+
+// waitJobs waits for the jobs the job is queued after to finish.
+// If one of them was superseded, the job also waits for the jobs
+// that took over the dependencies of its services, unless those
+// wait for the job themselves. It returns false if the Deployer
+// was closed while waiting.
+func (d *Deployer) waitJobs(job *Job) bool {
+	for i := 0; ; i++ {
+		d.mu.Lock()
+		if i == len(job.after) {
+			d.mu.Unlock()
+			return true
+		}
+		prev := job.after[i]
+		d.mu.Unlock()
+
+		select {
+		case <-prev.done:
+		case <-d.done:
+			return false
+		}
+
+		d.mu.Lock()
+		for service, id := range prev.SupersededBy {
+			next := d.jobs[id]
+			if next == nil || next.State.Done() || !job.dependsOn(service) {
+				continue
+			}
+			if waitsFor(job, next) || waitsFor(next, job) {
+				// Already waiting, or waiting would deadlock
+				continue
+			}
+			job.after = append(job.after, next)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// dependsOn returns whether any service of the
+// job depends on the service. d.mu must be held.
+func (j *Job) dependsOn(service string) bool {
+	for _, s := range j.services {
+		if sliceContains(s.DependsOn, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitsFor returns whether the job is, or waits for, the other
+// job, directly or through the jobs it waits for. d.mu must be held.
+func waitsFor(job, other *Job) bool {
+	if job == other {
+		return true
+	}
+	for _, prev := range job.after {
+		if !prev.State.Done() && waitsFor(prev, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// restartDependents restarts the running containers of the
+// services depending on the service, other than those the job
+// deploys itself. Failing to restart a service doesn't fail the job.
+func (d *Deployer) restartDependents(job *Job, service config.Service, logger *logrus.Entry) {
+	for _, name := range d.index().dependents[service.Name] {
+		d.mu.Lock()
+		deploying := sliceContains(job.Services, name)
+		d.mu.Unlock()
+		if deploying {
+			continue
+		}
+		d.restartService(job, name, logger.WithFields(logrus.Fields{
+			"name":       name,
+			"depends_on": service.Name,
+		}))
+	}
+}
+
+// restartService restarts the running containers of
+// the service while holding the service lock.
+func (d *Deployer) restartService(job *Job, name string, logger *logrus.Entry) {
+	service, ok := d.index().services[name]
+	if !ok {
+		return
+	}
+	lock := d.serviceLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var restarted bool
+	for _, n := range service.ContainerNames() {
+		logger := replicaLogger(service, n, logger)
+		id := d.findContainer(d.ctx, n, logger)
+		if id == "" {
+			logger.Debug("Dependent service has no container, not restarting")
+			continue
+		}
+		c := d.inspectContainer(d.ctx, id, logger)
+		if c == nil || !c.State.Running {
+			logger.Debug("Dependent service is not running, not restarting")
+			continue
+		}
+
+		err := d.client.RestartContainer(id, 10)
+		if err != nil {
+			logger.WithError(err).WithField("id", id).Error("Failed to restart dependent service")
+			// Soldier on anyway
+			continue
+		}
+		logger.WithField("id", id).Info("Restarted dependent service")
+		restarted = true
+	}
+	if !restarted {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.Restarted = append(job.Restarted, name)
+	job.Updated = time.Now()
+}
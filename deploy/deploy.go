@@ -0,0 +1,616 @@
+// Package deploy implements a queue of deploy jobs that is worked
+// through by a pool of workers, each of which pulls the pushed
+// image and replaces the containers of the affected services.
+package deploy
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/history"
+	"github.com/johanbrandhorst/redeploy/registry"
+)
+
+// ErrNoServices is returned when a push does not
+// match any configured service.
+var ErrNoServices = errors.New("no services configured for image")
+
+// maxJobs is the number of finished jobs kept for
+// status queries.
+const maxJobs = 1000
+
+// Deployer queues and executes deploy jobs.
+type Deployer struct {
+	logger        *logrus.Logger
+	client        *docker.Client
+	workers       int
+	debounce      time.Duration
+	healthTimeout time.Duration
+	monitor       time.Duration
+	history       *history.Store
+	keychain      *registry.Keychain
+	registry      *registry.Client
+	pollInterval  time.Duration
+	pollJitter    time.Duration
+	driftInterval time.Duration
+	secretsDir    string
+	// conf holds the *serviceIndex of the current configuration.
+	conf atomic.Value
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	queue  chan *Job
+	wg     sync.WaitGroup
+	// networkMu serializes creating networks.
+	networkMu sync.Mutex
+	// volumeMu serializes creating volumes.
+	volumeMu sync.Mutex
+	// startMu serializes starting containers, as the client
+	// looks up the API version of the server on every start
+	// without synchronization.
+	startMu sync.Mutex
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string
+	// latest is the most recently queued job for each service.
+	latest map[string]*Job
+	// locks serializes deploys of each service.
+	locks map[string]*sync.Mutex
+	// deployed is the time of the last successful
+	// deploy of each service.
+	deployed map[string]time.Time
+	// polled is the last digest found by polling
+	// that was deployed to each service, or empty
+	// for services that were rolled back since.
+	polled map[string]string
+	// drift is the drift last found for each service.
+	drift map[string][]Drift
+	// checks queues services to check for drift.
+	checks chan string
+}
+
+// DeployerOption is used to configure specific options
+// on the Deployer struct.
+type DeployerOption func(*Deployer)
+
+// WithLogger configures the logger to use.
+func WithLogger(l *logrus.Logger) DeployerOption {
+	return func(d *Deployer) {
+		d.logger = l
+	}
+}
+
+// WithWorkers configures the number of jobs
+// that may execute concurrently. Deploys of the same
+// service are always serialized. Defaults to 4.
+func WithWorkers(n int) DeployerOption {
+	return func(d *Deployer) {
+		d.workers = n
+	}
+}
+
+// WithDebounce configures how long a job waits before it is
+// started. If another push for the same service arrives
+// in the meantime, the waiting job is superseded by the newer one.
+func WithDebounce(t time.Duration) DeployerOption {
+	return func(d *Deployer) {
+		d.debounce = t
+	}
+}
+
+// WithHistory configures a store to record
+// the outcome of every deploy in.
+func WithHistory(s *history.Store) DeployerOption {
+	return func(d *Deployer) {
+		d.history = s
+	}
+}
+
+// WithKeychain configures the keychain to resolve the
+// credentials for pulling images with. By default, images
+// are pulled without credentials.
+func WithKeychain(k *registry.Keychain) DeployerOption {
+	return func(d *Deployer) {
+		d.keychain = k
+	}
+}
+
+// New creates a new Deployer, connects to the docker
+// host and starts the workers. Set DOCKER_HOST to configure
+// a custom docker endpoint.
+func New(conf *config.Config, opts ...DeployerOption) (*Deployer, error) {
+	d := &Deployer{
+		logger:        logrus.New(),
+		workers:       4,
+		healthTimeout: 2 * time.Minute,
+		monitor:       5 * time.Second,
+		secretsDir:    DefaultSecretsDir,
+		done:          make(chan struct{}),
+		queue:         make(chan *Job),
+		jobs:          map[string]*Job{},
+		latest:        map[string]*Job{},
+		locks:         map[string]*sync.Mutex{},
+		deployed:      map[string]time.Time{},
+		polled:        map[string]string{},
+		drift:         map[string][]Drift{},
+	}
+	d.logger.Out = ioutil.Discard
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	idx, err := newServiceIndex(conf)
+	if err != nil {
+		return nil, err
+	}
+	d.conf.Store(idx)
+
+	d.client, err = docker.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.client.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	if d.registry != nil && d.pollInterval > 0 {
+		d.wg.Add(1)
+		go d.poll()
+	}
+	if d.driftInterval > 0 {
+		d.checks = make(chan string, 100)
+		d.wg.Add(1)
+		go d.watch()
+	}
+
+	return d, nil
+}
+
+// Close stops the workers, any polling and drift detection, waiting
+// for any running jobs to finish. Jobs that have not started are dropped.
+func (d *Deployer) Close() {
+	close(d.done)
+	d.wg.Wait()
+	d.cancel()
+}
+
+// Enqueue queues a job deploying the pushed image to
+// all services configured to use it, or following its tag
+// by tag policy. The callback, if not nil, is called with
+// the final state of the job once it has finished.
+// Services are removed from any job that has not yet started
+// and deploy them in the new job instead. If the push has a
+// digest, services are matched by tag and deployed pinned
+// to the digest.
+// If no service uses the image, ErrNoServices is returned.
+func (d *Deployer) Enqueue(push Push, callback func(Job)) (Job, error) {
+	idx := d.index()
+	services, ok := idx.imageToService[push.Repository+":"+push.Tag]
+	if !ok && push.Tag == "latest" {
+		// For images of latest tag, tag is optional.
+		services = idx.imageToService[push.Repository]
+	}
+	// Don't modify the slice in the map
+	services = services[:len(services):len(services)]
+
+	var byPolicy bool
+	if push.Tag != "" {
+		for _, service := range idx.repoToPolicy[push.Repository] {
+			if idx.policies[service.Name].Match(push.Tag) {
+				services = append(services, service)
+				byPolicy = true
+			}
+		}
+	}
+
+	if len(services) == 0 {
+		return Job{}, ErrNoServices
+	}
+	idx.sortServices(services)
+
+	job := newJob(push, services, callback)
+	if byPolicy || push.Digest != "" {
+		job.image = push.Image()
+	}
+	job.ordered = byPolicy
+
+	return d.enqueue(job), nil
+}
+
+// enqueue stores the job and hands it to the workers,
+// removing its services from any jobs that have not yet started.
+func (d *Deployer) enqueue(job *Job) Job {
+	idx := d.index()
+	d.mu.Lock()
+	d.addJob(job)
+	// Iterate over a copy, as services may be removed
+	for _, service := range append([]config.Service(nil), job.services...) {
+		prev := d.latest[service.Name]
+		if job.ordered && prev != nil && prev.State != StateFailed {
+			if p := idx.policies[service.Name]; p != nil && p.Older(job.Push.Tag, prev.Push.Tag) {
+				d.logger.WithFields(logrus.Fields{
+					"job":  job.ID,
+					"name": service.Name,
+					"tag":  prev.Push.Tag,
+				}).Info("Ignoring push older than latest deploy of service")
+				job.ignore(service.Name, prev.Push.Tag)
+				continue
+			}
+		}
+		d.latest[service.Name] = job
+		if prev == nil || prev.State != StateQueued {
+			continue
+		}
+		d.logger.WithFields(logrus.Fields{
+			"job":  prev.ID,
+			"by":   job.ID,
+			"name": service.Name,
+		}).Info("Superseding deploy of service")
+		prev.supersede(service.Name, job)
+		if len(prev.services) == 0 {
+			prev.setState(StateSuperseded)
+			go d.finish(prev)
+		}
+	}
+	job.after = d.dependencyJobs(job)
+	if len(job.services) == 0 {
+		// Every service already follows a newer tag
+		job.setState(StateSucceeded)
+		c := job.copy()
+		d.mu.Unlock()
+		go d.finish(job)
+		return c
+	}
+	c := job.copy()
+	d.mu.Unlock()
+
+	d.logger.WithFields(logrus.Fields{
+		"job":   job.ID,
+		"image": job.Push.Image(),
+	}).Debug("Queued job")
+
+	// Hand the job to a worker without blocking the caller.
+	time.AfterFunc(d.debounce, func() {
+		if !d.waitJobs(job) {
+			return
+		}
+		select {
+		case d.queue <- job:
+		case <-d.done:
+		}
+	})
+
+	return c
+}
+
+// Job returns the job with the provided ID.
+func (d *Deployer) Job(id string) (Job, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, ok := d.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.copy(), true
+}
+
+// addJob stores the job, evicting the oldest finished
+// jobs if necessary. d.mu must be held.
+func (d *Deployer) addJob(job *Job) {
+	d.jobs[job.ID] = job
+	d.order = append(d.order, job.ID)
+	for i := 0; len(d.jobs) > maxJobs && i < len(d.order); {
+		id := d.order[i]
+		if !d.jobs[id].State.Done() {
+			i++
+			continue
+		}
+		delete(d.jobs, id)
+		d.order = append(d.order[:i], d.order[i+1:]...)
+	}
+}
+
+func (d *Deployer) setState(job *Job, state State) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.setState(state)
+}
+
+func (d *Deployer) addError(job *Job, service string, step State, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.Errors = append(job.Errors, StepError{
+		Service: service,
+		Step:    step,
+		Error:   err.Error(),
+	})
+	job.Updated = time.Now()
+}
+
+// serviceLock returns the lock serializing deploys of the service.
+func (d *Deployer) serviceLock(service string) *sync.Mutex {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lock, ok := d.locks[service]
+	if !ok {
+		lock = &sync.Mutex{}
+		d.locks[service] = lock
+	}
+	return lock
+}
+
+// start marks the job as started, after which services
+// can no longer be removed from it. The services to deploy
+// are returned, or false if the job has been superseded.
+func (d *Deployer) start(job *Job) ([]config.Service, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if job.State != StateQueued {
+		return nil, false
+	}
+	job.setState(StatePulling)
+	return job.services, true
+}
+
+// superseded checks whether a newer job has been queued for the
+// service, in which case it is removed from the job.
+func (d *Deployer) superseded(job *Job, service string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	latest := d.latest[service]
+	if latest == nil || latest == job {
+		return false
+	}
+	job.supersede(service, latest)
+	return true
+}
+
+func (d *Deployer) finish(job *Job) {
+	d.mu.Lock()
+	c := job.copy()
+	d.mu.Unlock()
+	close(job.done)
+
+	if d.history != nil {
+		err := d.history.Add(records(c)...)
+		if err != nil {
+			d.logger.WithError(err).WithField("job", c.ID).Error("Failed to record job in history")
+		}
+	}
+
+	if job.callback != nil {
+		job.callback(c)
+	}
+}
+
+func (d *Deployer) setDeployed(service string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deployed[service] = time.Now()
+}
+
+func (d *Deployer) addRollback(job *Job, service, image string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if job.RolledBack == nil {
+		job.RolledBack = map[string]string{}
+	}
+	job.RolledBack[service] = image
+	job.Updated = time.Now()
+}
+
+func (d *Deployer) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case job := <-d.queue:
+			d.run(job)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *Deployer) run(job *Job) {
+	services, ok := d.start(job)
+	if !ok {
+		return
+	}
+
+	logger := d.logger.WithFields(logrus.Fields{
+		"job":   job.ID,
+		"image": job.Push.Image(),
+	})
+
+	state := StateSuperseded
+	err := d.pull(d.ctx, job, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to pull image")
+		d.addError(job, "", StatePulling, err)
+		state = StateFailed
+	} else {
+		d.setState(job, StateReplacing)
+		for _, service := range services {
+			deployed, err := d.deployService(job, service, logger)
+			if err != nil {
+				logger.WithError(err).WithField("name", service.Name).Error("Failed to replace container")
+				d.addError(job, service.Name, StateReplacing, err)
+				state = StateFailed
+			} else if deployed && state != StateFailed {
+				state = StateSucceeded
+			}
+			if deployed && err == nil && service.RestartDependents() {
+				d.restartDependents(job, service, logger)
+			}
+		}
+	}
+
+	d.mu.Lock()
+	if state == StateSuperseded && len(job.Ignored) > 0 {
+		// Services already following a newer tag are up to date
+		state = StateSucceeded
+	}
+	d.mu.Unlock()
+
+	d.setState(job, state)
+	logger.WithField("state", state).Info("Finished job")
+
+	d.finish(job)
+	for _, service := range services {
+		d.recheck(service.Name)
+	}
+}
+
+// deployService replaces the container of the service while holding
+// the service lock. It returns false if the service was skipped because
+// a newer job for it has been queued, or because it runs a newer tag
+// under its tag policy.
+func (d *Deployer) deployService(job *Job, service config.Service, logger *logrus.Entry) (bool, error) {
+	lock := d.serviceLock(service.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if d.superseded(job, service.Name) {
+		logger.WithField("name", service.Name).Info("Skipping service superseded by newer push")
+		return false, nil
+	}
+
+	if job.ordered && d.runningNewer(job, service, logger) {
+		return false, nil
+	}
+
+	err := d.replace(d.ctx, job, service, logger)
+	if err == nil {
+		d.setDeployed(service.Name)
+	}
+	return true, err
+}
+
+// runningNewer checks whether the service runs a tag that is newer
+// under its tag policy than the pushed one, in which case the
+// service is removed from the job.
+func (d *Deployer) runningNewer(job *Job, service config.Service, logger *logrus.Entry) bool {
+	image := d.runningImage(d.ctx, containerName(service), logger)
+	if image == "" {
+		return false
+	}
+	repo, tag, _ := parseImage(image)
+	p := d.index().policies[service.Name]
+	if p == nil || repo != job.Push.Repository || !p.Older(job.Push.Tag, tag) {
+		return false
+	}
+
+	logger.WithFields(logrus.Fields{
+		"name": service.Name,
+		"tag":  tag,
+	}).Info("Skipping service running newer tag")
+	d.mu.Lock()
+	job.ignore(service.Name, tag)
+	d.mu.Unlock()
+	return true
+}
+
+// pull pulls the image of the job and pins the job to the
+// digest of the pulled image. If the push declares a digest
+// but the pulled tag has another, an error is returned.
+func (d *Deployer) pull(ctx context.Context, job *Job, logger *logrus.Entry) error {
+	if job.Push.Tag == "" && job.Push.Digest != "" {
+		// Rollbacks may refer to an image by its ID, in which
+		// case it can only be used if it still exists locally.
+		_, err := d.client.InspectImage(job.Push.Digest)
+		if err == nil {
+			logger.Debug("Image present locally")
+			d.mu.Lock()
+			job.image = job.Push.Digest
+			d.mu.Unlock()
+			return nil
+		}
+	}
+
+	var auth docker.AuthConfiguration
+	if d.keychain != nil {
+		var err error
+		auth, err = d.keychain.Credentials(job.Push.Repository)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to resolve registry credentials, pulling anonymously")
+		}
+	}
+
+	logger.WithField("authenticated", auth.Username != "").Debug("Pulling image")
+
+	tag, ref := job.Push.Tag, job.Push.Repository+":"+job.Push.Tag
+	if tag == "" {
+		tag, ref = job.Push.Digest, job.Push.Repository+"@"+job.Push.Digest
+	}
+	err := d.client.PullImage(docker.PullImageOptions{
+		Repository:   job.Push.Repository,
+		Tag:          tag,
+		Context:      ctx,
+		OutputStream: d.logger.Out,
+	}, auth)
+	if err != nil {
+		return err
+	}
+
+	digests := d.imageDigests(job.Push.Repository, ref, logger)
+	var digest string
+	switch {
+	case job.Push.Digest != "":
+		if !sliceContains(digests, job.Push.Digest) {
+			return errors.Errorf("pulled image %s does not have the pushed digest %s", ref, job.Push.Digest)
+		}
+		digest = job.Push.Digest
+	case len(digests) > 0:
+		digest = digests[0]
+	default:
+		logger.Warn("Pulled image has no digest, deploying by tag")
+	}
+
+	d.mu.Lock()
+	job.Digest = digest
+	if digest != "" {
+		// Create containers from exactly the pulled image,
+		// even if the tag moves on in the meantime.
+		job.image = job.Push.Repository + "@" + digest
+	}
+	d.mu.Unlock()
+
+	return nil
+}
+
+// imageDigests returns the registry digests of the
+// pulled image in the repository.
+func (d *Deployer) imageDigests(repo, image string, logger *logrus.Entry) []string {
+	img, err := d.client.InspectImage(image)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to inspect pulled image")
+		// Soldier on anyway
+		return nil
+	}
+	var digests []string
+	for _, digest := range img.RepoDigests {
+		if strings.HasPrefix(digest, repo+"@") {
+			digests = append(digests, strings.TrimPrefix(digest, repo+"@"))
+		}
+	}
+	return digests
+}
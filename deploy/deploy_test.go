@@ -0,0 +1,2031 @@
+package deploy_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/cli/cli/compose/types"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-test/deep"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/deploy"
+	"github.com/johanbrandhorst/redeploy/history"
+	"github.com/johanbrandhorst/redeploy/internal/dockertest"
+	"github.com/johanbrandhorst/redeploy/internal/registrytest"
+	"github.com/johanbrandhorst/redeploy/registry"
+)
+
+func newDeployer(t *testing.T, services []config.Service, opts ...deploy.DeployerOption) (*deploy.Deployer, *dockertest.Server) {
+	s := dockertest.NewServer()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{
+		Config: types.Config{
+			Version: "3.0",
+		},
+		Services: services,
+	}
+	opts = append([]deploy.DeployerOption{
+		deploy.WithLogger(logrus.New()),
+		deploy.WithMonitor(50 * time.Millisecond),
+	}, opts...)
+	d, err := deploy.New(conf, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, s
+}
+
+func waitForJob(t *testing.T, d *deploy.Deployer, id string) deploy.Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := d.Job(id)
+		if !ok {
+			t.Fatalf("Job %q not found", id)
+		}
+		if job.State.Done() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for job %q", id)
+	return deploy.Job{}
+}
+
+func TestDeploy(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: "test/test1",
+	}})
+	defer s.Close()
+	defer d.Close()
+
+	oldID := s.AddContainer("test", "test/test1")
+
+	done := make(chan deploy.Job, 1)
+	job, err := d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "latest",
+	}, func(job deploy.Job) {
+		done <- job
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != deploy.StateQueued {
+		t.Errorf("Got state %q, expected %q", job.State, deploy.StateQueued)
+	}
+
+	select {
+	case job = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for callback")
+	}
+
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+
+	if _, ok := s.Container(oldID); ok {
+		t.Error("Old container was not removed")
+	}
+	c, ok := s.Container("test")
+	if !ok {
+		t.Fatal("New container was not created")
+	}
+	if !c.State.Running {
+		t.Error("New container was not started")
+	}
+}
+
+func TestDeployFailure(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: "test/test1",
+	}})
+	defer s.Close()
+	defer d.Close()
+
+	s.Fail("POST /containers/create", 1)
+
+	job, err := d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "latest",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateFailed {
+		t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if len(job.Errors) != 1 {
+		t.Fatalf("Got %d errors, expected 1", len(job.Errors))
+	}
+	if job.Errors[0].Service != "test" || job.Errors[0].Step != deploy.StateReplacing {
+		t.Errorf("Unexpected error: %+v", job.Errors[0])
+	}
+}
+
+func TestDigestPinning(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: "test/test1",
+	}})
+	defer s.Close()
+	defer d.Close()
+
+	s.AddContainer("test", "test/test1")
+	digest := s.Push("test/test1")
+
+	job, err := d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "latest",
+		Digest:     digest,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	c, ok := s.Container("test")
+	if !ok {
+		t.Fatal("Service container does not exist")
+	}
+	if c.Config.Image != "test/test1@"+digest {
+		t.Errorf("Got container image %q, expected %q", c.Config.Image, "test/test1@"+digest)
+	}
+	if c.Config.Labels[deploy.DigestLabel] != digest {
+		t.Errorf("Got digest label %q, expected %q", c.Config.Labels[deploy.DigestLabel], digest)
+	}
+
+	// The tag has moved on to another image since the push
+	job, err = d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "latest",
+		Digest:     "sha256:stale",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateFailed {
+		t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if len(job.Errors) != 1 || job.Errors[0].Step != deploy.StatePulling {
+		t.Errorf("Unexpected errors: %+v", job.Errors)
+	}
+	if c, ok := s.Container("test"); !ok || c.Config.Labels[deploy.DigestLabel] != digest {
+		t.Error("Service was redeployed from mismatched digest")
+	}
+}
+
+func TestNoServices(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: "test/test1",
+	}})
+	defer s.Close()
+	defer d.Close()
+
+	_, err := d.Enqueue(deploy.Push{
+		Repository: "test/other",
+		Tag:        "latest",
+	}, nil)
+	if err != deploy.ErrNoServices {
+		t.Fatalf("Got error %v, expected %v", err, deploy.ErrNoServices)
+	}
+
+	if _, ok := d.Job("unknown"); ok {
+		t.Error("Found unknown job")
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:  "test",
+			Image: "test/test1",
+		},
+		{
+			Name:  "other",
+			Image: "test/test1:v1",
+		},
+	}, deploy.WithDebounce(100*time.Millisecond))
+	defer s.Close()
+	defer d.Close()
+
+	push := deploy.Push{
+		Repository: "test/test1",
+		Tag:        "latest",
+	}
+	first, err := d.Enqueue(push, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.Enqueue(push, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := d.Enqueue(push, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first = waitForJob(t, d, first.ID)
+	if first.State != deploy.StateSuperseded {
+		t.Errorf("Got state %q, expected %q", first.State, deploy.StateSuperseded)
+	}
+	if first.SupersededBy["test"] != second.ID {
+		t.Errorf("Got superseding job %q, expected %q", first.SupersededBy["test"], second.ID)
+	}
+	second = waitForJob(t, d, second.ID)
+	if second.State != deploy.StateSuperseded {
+		t.Errorf("Got state %q, expected %q", second.State, deploy.StateSuperseded)
+	}
+	third = waitForJob(t, d, third.ID)
+	if third.State != deploy.StateSucceeded {
+		t.Errorf("Got state %q, expected %q", third.State, deploy.StateSucceeded)
+	}
+
+	var creates int
+	for _, call := range s.Calls() {
+		if call == "POST /containers/create" {
+			creates++
+		}
+	}
+	if creates != 1 {
+		t.Errorf("Got %d containers created, expected 1", creates)
+	}
+
+	// Pushes for unrelated services do not supersede each other
+	v1, err := d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "v1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := d.Enqueue(push, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 = waitForJob(t, d, v1.ID)
+	if v1.State != deploy.StateSucceeded {
+		t.Errorf("Got state %q, expected %q", v1.State, deploy.StateSucceeded)
+	}
+	latest = waitForJob(t, d, latest.ID)
+	if latest.State != deploy.StateSucceeded {
+		t.Errorf("Got state %q, expected %q", latest.State, deploy.StateSucceeded)
+	}
+}
+
+func TestStartFirst(t *testing.T) {
+	services := []config.Service{{
+		Name:  "test",
+		Image: "test/test1",
+		HealthCheck: &types.HealthCheckConfig{
+			Test: types.HealthCheckTest{"CMD", "true"},
+		},
+		Deploy: types.DeployConfig{
+			UpdateConfig: &types.UpdateConfig{
+				Order: "start-first",
+			},
+		},
+	}}
+
+	t.Run("Healthy", func(t *testing.T) {
+		d, s := newDeployer(t, services)
+		defer s.Close()
+		defer d.Close()
+
+		oldID := s.AddContainer("test", "test/test1")
+
+		job, err := d.Enqueue(deploy.Push{
+			Repository: "test/test1",
+			Tag:        "latest",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+
+		if _, ok := s.Container(oldID); ok {
+			t.Error("Old container was not removed")
+		}
+		c, ok := s.Container("test")
+		if !ok {
+			t.Fatal("New container was not renamed")
+		}
+		if c.ID == oldID || !c.State.Running {
+			t.Error("New container is not running")
+		}
+		if len(s.Containers()) != 1 {
+			t.Errorf("Got containers %v, expected only the new container", s.Containers())
+		}
+
+		// The old container must only be stopped once the new one is healthy
+		var calls []string
+		for _, call := range s.Calls() {
+			if strings.HasPrefix(call, "POST /containers/") {
+				calls = append(calls, call)
+			}
+		}
+		newID := c.ID
+		expected := []string{
+			"POST /containers/create",
+			"POST /containers/" + newID + "/start",
+			"POST /containers/" + oldID + "/stop",
+			"POST /containers/" + oldID + "/rename",
+			"POST /containers/" + newID + "/rename",
+		}
+		if diff := deep.Equal(calls, expected); diff != nil {
+			t.Errorf("Unexpected calls:\n%v", strings.Join(diff, "\n"))
+		}
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		d, s := newDeployer(t, services)
+		defer s.Close()
+		defer d.Close()
+
+		oldID := s.AddContainer("test", "test/test1")
+		s.SetHealth("test/test1", "unhealthy")
+
+		job, err := d.Enqueue(deploy.Push{
+			Repository: "test/test1",
+			Tag:        "latest",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateFailed {
+			t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+		}
+
+		c, ok := s.Container("test")
+		if !ok {
+			t.Fatal("Old container was removed")
+		}
+		if c.ID != oldID || !c.State.Running {
+			t.Error("Old container is not running")
+		}
+		if len(s.Containers()) != 1 {
+			t.Errorf("Got containers %v, expected only the old container", s.Containers())
+		}
+	})
+}
+
+func TestHealth(t *testing.T) {
+	healthCheck := &types.HealthCheckConfig{
+		Test: types.HealthCheckTest{"CMD", "true"},
+	}
+	testCases := []struct {
+		Name        string
+		HealthCheck *types.HealthCheckConfig
+		Health      string
+		ExitCode    *int
+		Error       string
+	}{
+		{
+			Name: "Running",
+		},
+		{
+			Name:     "Exited",
+			ExitCode: new(int),
+			Error:    "container exited with code 0",
+		},
+		{
+			Name:        "Healthy",
+			HealthCheck: healthCheck,
+		},
+		{
+			Name:        "Unhealthy",
+			HealthCheck: healthCheck,
+			Health:      "unhealthy",
+			Error:       "container is unhealthy: last health check exited with code 1: health check failed",
+		},
+		{
+			Name:        "Starting",
+			HealthCheck: healthCheck,
+			Health:      "starting",
+			Error:       "timed out after 200ms waiting for container to become healthy: last health check exited with code 0: ok",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			d, s := newDeployer(t, []config.Service{{
+				Name:        "test",
+				Image:       "test/test1",
+				HealthCheck: testCase.HealthCheck,
+			}}, deploy.WithHealthTimeout(200*time.Millisecond))
+			defer s.Close()
+			defer d.Close()
+
+			if testCase.Health != "" {
+				s.SetHealth("test/test1", testCase.Health)
+			}
+			if testCase.ExitCode != nil {
+				s.SetExitCode("test/test1", *testCase.ExitCode)
+			}
+
+			job, err := d.Enqueue(deploy.Push{
+				Repository: "test/test1",
+				Tag:        "latest",
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			job = waitForJob(t, d, job.ID)
+			if testCase.Error == "" {
+				if job.State != deploy.StateSucceeded {
+					t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+				}
+				return
+			}
+
+			if job.State != deploy.StateFailed {
+				t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+			}
+			if len(job.Errors) != 1 {
+				t.Fatalf("Got %d errors, expected 1", len(job.Errors))
+			}
+			if job.Errors[0].Error != testCase.Error {
+				t.Errorf("Got error %q, expected %q", job.Errors[0].Error, testCase.Error)
+			}
+		})
+	}
+}
+
+func TestManage(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: "test/test1:v2",
+	}, {
+		Name:  "other",
+		Image: "test/other",
+	}})
+	defer s.Close()
+	defer d.Close()
+
+	v1 := s.AddImage("test/test1:v1")
+	s.AddContainer("test", "test/test1:v1")
+
+	job, err := d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(job.Push, deploy.Push{Repository: "test/test1", Tag: "v2"}); diff != nil {
+		t.Error(diff)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+
+	statuses, err := d.Services(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("Got %d services, expected 2", len(statuses))
+	}
+	if statuses[0].Name != "test" || statuses[0].State != "running" || statuses[0].LastDeploy == nil {
+		t.Errorf("Unexpected status: %+v", statuses[0])
+	}
+	if statuses[0].ImageID == v1 || len(statuses[0].Digests) != 1 {
+		t.Errorf("Unexpected image of redeployed service: %+v", statuses[0])
+	}
+	if statuses[1].Name != "other" || statuses[1].State != "missing" || statuses[1].LastDeploy != nil {
+		t.Errorf("Unexpected status: %+v", statuses[1])
+	}
+
+	t.Run("RollbackToID", func(t *testing.T) {
+		job, err := d.Rollback("test", v1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+		c, ok := s.Container("test")
+		if !ok {
+			t.Fatal("Service container does not exist")
+		}
+		if c.Image != v1 {
+			t.Errorf("Got container image %q, expected %q", c.Image, v1)
+		}
+	})
+
+	t.Run("RollbackToTag", func(t *testing.T) {
+		job, err := d.Rollback("test", "v0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+		c, ok := s.Container("test")
+		if !ok {
+			t.Fatal("Service container does not exist")
+		}
+		if c.Config.Labels[deploy.ImageLabel] != "test/test1:v0" {
+			t.Errorf("Got container image %q, expected %q", c.Config.Labels[deploy.ImageLabel], "test/test1:v0")
+		}
+	})
+
+	t.Run("UnknownService", func(t *testing.T) {
+		_, err := d.Redeploy("missing", nil)
+		if err != deploy.ErrUnknownService {
+			t.Errorf("Got error %v, expected %v", err, deploy.ErrUnknownService)
+		}
+		_, err = d.Rollback("missing", "v1", nil)
+		if err != deploy.ErrUnknownService {
+			t.Errorf("Got error %v, expected %v", err, deploy.ErrUnknownService)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: "test/test1",
+	}}, deploy.WithHistory(store))
+	defer s.Close()
+	defer d.Close()
+
+	prevImage := s.AddImage("test/test1")
+	s.AddContainer("test", "test/test1")
+	// Containers created from the new image crash on startup
+	s.SetExitCode("test/test1", 1)
+
+	job, err := d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "latest",
+		Pusher:     "someone",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+
+	records := store.Query("test", time.Time{})
+	if len(records) != 1 {
+		t.Fatalf("Got %d records, expected 1", len(records))
+	}
+	r := records[0]
+	if r.Job != job.ID || r.Pusher != "someone" || r.Tag != "latest" {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	if r.Digest == "" || r.Digest != job.Digest {
+		t.Errorf("Got digest %q, expected %q", r.Digest, job.Digest)
+	}
+	if r.Outcome != string(deploy.StateFailed) || !strings.Contains(r.Error, "container exited with code 1") {
+		t.Errorf("Unexpected outcome %q: %q", r.Outcome, r.Error)
+	}
+	if r.RolledBack != prevImage {
+		t.Errorf("Got rolled back image %q, expected %q", r.RolledBack, prevImage)
+	}
+	var steps []string
+	for _, step := range r.Steps {
+		steps = append(steps, step.Name)
+	}
+	expected := []string{"queued", "pulling", "replacing", "rolling-back", "replacing", "failed"}
+	if diff := deep.Equal(steps, expected); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	keychain, err := registry.NewKeychain("/nonexistent", map[string]config.RegistryAuth{
+		"registry.example.com": {Username: "bot", Password: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	logger.Level = logrus.DebugLevel
+
+	for _, testCase := range []struct {
+		Name     string
+		Options  []deploy.DeployerOption
+		Expected deploy.State
+	}{
+		{"WithCredentials", []deploy.DeployerOption{deploy.WithKeychain(keychain)}, deploy.StateSucceeded},
+		{"WithoutCredentials", nil, deploy.StateFailed},
+	} {
+		d, s := newDeployer(t, []config.Service{{
+			Name:  "test",
+			Image: "registry.example.com/test/test1",
+		}}, append(testCase.Options, deploy.WithLogger(logger))...)
+
+		s.RequireAuth("registry.example.com/test/test1", "bot", "secret")
+
+		job, err := d.Enqueue(deploy.Push{
+			Repository: "registry.example.com/test/test1",
+			Tag:        "latest",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForJob(t, d, job.ID)
+		if job.State != testCase.Expected {
+			t.Errorf("For %s: got state %q, expected %q: %v", testCase.Name, job.State, testCase.Expected, job.Errors)
+		}
+
+		d.Close()
+		s.Close()
+	}
+
+	if strings.Contains(logs.String(), "secret") {
+		t.Error("Credentials were logged")
+	}
+}
+
+func TestPolling(t *testing.T) {
+	reg := registrytest.NewServer()
+	defer reg.Close()
+
+	d, s := newDeployer(t, []config.Service{{
+		Name:  "test",
+		Image: reg.Host() + "/test/test1",
+	}, {
+		Name:   "other",
+		Image:  reg.Host() + "/test/other",
+		Labels: map[string]string{config.PollLabel: "false"},
+	}}, deploy.WithPolling(registry.NewClient(nil), 20*time.Millisecond, 10*time.Millisecond))
+	defer s.Close()
+	defer d.Close()
+
+	current := s.AddImage(reg.Host() + "/test/test1")
+	oldID := s.AddContainer("test", reg.Host()+"/test/test1")
+	reg.SetDigest("test/test1", "latest", current)
+	s.AddImage(reg.Host() + "/test/other")
+	s.AddContainer("other", reg.Host()+"/test/other")
+	reg.SetDigest("test/other", "latest", "sha256:other")
+
+	creates := func() int {
+		n := 0
+		for _, call := range s.Calls() {
+			if call == "POST /containers/create" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Wait for a few polls
+	deadline := time.Now().Add(5 * time.Second)
+	for reg.Requests() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := creates(); n != 0 {
+		t.Fatalf("Got %d deploys of up to date service, expected none", n)
+	}
+
+	reg.SetDigest("test/test1", "latest", "sha256:new")
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if c, ok := s.Container("test"); ok && c.ID != oldID && c.State.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c, ok := s.Container("test"); !ok || c.ID == oldID {
+		t.Fatal("Service was not redeployed after digest changed")
+	}
+
+	// The digest of the pulled image differs from that of the
+	// registry stand-in, but the same digest is not redeployed.
+	requests := reg.Requests()
+	for reg.Requests() < requests+3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := creates(); n != 1 {
+		t.Errorf("Got %d deploys, expected 1", n)
+	}
+
+	// Rollbacks are kept until another digest is pushed
+	job, err := d.Rollback("test", "v0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	requests = reg.Requests()
+	for reg.Requests() < requests+3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := creates(); n != 2 {
+		t.Errorf("Got %d deploys, expected 2", n)
+	}
+	reg.SetDigest("test/test1", "latest", "sha256:newer")
+	for creates() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := creates(); n != 3 {
+		t.Errorf("Got %d deploys after digest changed, expected 3", n)
+	}
+}
+
+func TestTagPolicy(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{{
+		Name:   "test",
+		Image:  "test/test1:1.4.2",
+		Labels: map[string]string{config.TagPolicyLabel: "semver:~1.4"},
+	}, {
+		Name:   "other",
+		Image:  "test/test1:1.4.2",
+		Labels: map[string]string{config.TagPolicyLabel: "semver:~1.4"},
+	}})
+	defer s.Close()
+	defer d.Close()
+
+	s.AddImage("test/test1:1.4.2")
+	s.AddContainer("test", "test/test1:1.4.2")
+	s.AddImage("test/test1:1.4.9")
+	otherID := s.AddContainer("other", "test/test1:1.4.9")
+
+	job, err := d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "1.4.7",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q", job.State, deploy.StateSucceeded)
+	}
+	if c, ok := s.Container("test"); !ok || c.Config.Labels[deploy.ImageLabel] != "test/test1:1.4.7" {
+		t.Errorf("Service was not deployed from pushed tag")
+	}
+	// The service running a newer tag is left alone
+	if c, ok := s.Container("other"); !ok || c.ID != otherID {
+		t.Errorf("Service running newer tag was redeployed")
+	}
+	if diff := deep.Equal(job.Ignored, map[string]string{"other": "1.4.9"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// A late push of an older tag is ignored
+	job, err = d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "1.4.3",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Errorf("Got state %q, expected %q", job.State, deploy.StateSucceeded)
+	}
+	if len(job.Services) != 0 {
+		t.Errorf("Got services %v, expected none", job.Services)
+	}
+	if diff := deep.Equal(job.Ignored, map[string]string{"test": "1.4.7", "other": "1.4.7"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Tags outside the range don't match
+	_, err = d.Enqueue(deploy.Push{
+		Repository: "test/test1",
+		Tag:        "1.5.0",
+	}, nil)
+	if err != deploy.ErrNoServices {
+		t.Errorf("Got error %v, expected %v", err, deploy.ErrNoServices)
+	}
+
+	// Redeploys use the running tag
+	job, err = d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Push.Tag != "1.4.7" {
+		t.Errorf("Got tag %q, expected %q", job.Push.Tag, "1.4.7")
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Errorf("Got state %q, expected %q", job.State, deploy.StateSucceeded)
+	}
+	if c, ok := s.Container("test"); !ok || c.Config.Labels[deploy.ImageLabel] != "test/test1:1.4.7" {
+		t.Errorf("Service was not redeployed from running tag")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	foo := "bar"
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:  "current",
+			Image: "test/test1",
+		},
+		{
+			Name:        "drifted",
+			Image:       "test/test2",
+			Environment: types.MappingWithEquals{"FOO": &foo},
+		},
+		{
+			Name:  "missing",
+			Image: "test/test3",
+		},
+	})
+	defer s.Close()
+	defer d.Close()
+
+	s.AddImage("test/test1")
+	currentID := s.AddContainer("current", "test/test1")
+	s.AddImage("test/test2")
+	driftedID := s.AddContainer("drifted", "test/test2")
+
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Got %d jobs, expected none", len(jobs))
+	}
+
+	reconcile := func(mode deploy.ReconcileMode, expected []string) {
+		t.Helper()
+		jobs, err := d.Reconcile(context.Background(), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var services []string
+		for _, job := range jobs {
+			job = waitForJob(t, d, job.ID)
+			if job.State != deploy.StateSucceeded {
+				t.Errorf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+			}
+			services = append(services, job.Services...)
+		}
+		if diff := deep.Equal(services, expected); diff != nil {
+			t.Errorf("For %s: %v", mode, diff)
+		}
+	}
+
+	reconcile(deploy.ReconcileMissing, []string{"missing"})
+	if _, ok := s.Container("missing"); !ok {
+		t.Error("Missing service was not deployed")
+	}
+	if c, ok := s.Container("drifted"); !ok || c.ID != driftedID {
+		t.Error("Drifted service was redeployed")
+	}
+
+	reconcile(deploy.ReconcileDrift, []string{"drifted"})
+	c, ok := s.Container("drifted")
+	if !ok || c.ID == driftedID {
+		t.Fatal("Drifted service was not redeployed")
+	}
+	if !sliceContains(c.Config.Env, "FOO=bar") {
+		t.Errorf("Got environment %v, expected FOO=bar", c.Config.Env)
+	}
+	if c, ok := s.Container("current"); !ok || c.ID != currentID {
+		t.Error("Up to date service was redeployed")
+	}
+
+	// Containers created by redeploy match their configuration
+	reconcile(deploy.ReconcileDrift, nil)
+
+	if _, err := deploy.ParseReconcileMode("always"); err == nil {
+		t.Error("Expected error for unknown reconcile mode")
+	}
+}
+
+func sliceContains(slice []string, in string) bool {
+	for _, s := range slice {
+		if s == in {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDriftDetection(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:   "ignored",
+			Image:  "test/test1",
+			Labels: map[string]string{config.DriftLabel: string(config.DriftIgnore)},
+		},
+		{
+			Name:   "repaired",
+			Image:  "test/test1",
+			Labels: map[string]string{config.DriftLabel: string(config.DriftRepair)},
+		},
+		{
+			Name:  "reported",
+			Image: "test/test1",
+		},
+	}, deploy.WithDriftDetection(time.Hour))
+	defer s.Close()
+	defer d.Close()
+
+	eventually := func(msg string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	deployed := func(name string) *time.Time {
+		statuses, err := d.Services(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range statuses {
+			if status.Name == name {
+				return status.LastDeploy
+			}
+		}
+		return nil
+	}
+
+	// Missing containers are repaired on startup
+	eventually("Missing container was not repaired", func() bool {
+		return deployed("repaired") != nil
+	})
+	c, ok := s.Container("repaired")
+	if !ok || !c.State.Running {
+		t.Fatal("Repaired container is not running")
+	}
+	repairedID, repairedAt := c.ID, *deployed("repaired")
+	missing := []deploy.Drift{{Field: "container", Want: "running", Have: "missing"}}
+	eventually("Missing container was not reported", func() bool {
+		return deep.Equal(d.Drift()["reported"], missing) == nil
+	})
+	if _, ok := s.Container("ignored"); ok {
+		t.Error("Ignored service was deployed")
+	}
+	if _, ok := d.Drift()["ignored"]; ok {
+		t.Error("Drift of ignored service was reported")
+	}
+
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone stops the container by hand
+	err = client.StopContainer(repairedID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually("Stopped container was not repaired", func() bool {
+		t := deployed("repaired")
+		return t != nil && t.After(repairedAt)
+	})
+	if c, ok := s.Container("repaired"); !ok || c.ID == repairedID || !c.State.Running {
+		t.Error("Stopped container was not replaced")
+	}
+	eventually("Repaired drift is still reported", func() bool {
+		_, ok := d.Drift()["repaired"]
+		return !ok
+	})
+
+	// Someone runs another image by hand
+	s.AddImage("test/other")
+	_, err = client.CreateContainer(docker.CreateContainerOptions{
+		Name: "reported",
+		Config: &docker.Config{
+			Image: "test/other",
+			Env:   []string{"FOO=bar"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []deploy.Drift{
+		{Field: "container", Want: "running", Have: "created"},
+		{Field: "image", Want: "test/test1", Have: "test/other"},
+	}
+	eventually("Drift of container was not reported", func() bool {
+		return deep.Equal(d.Drift()["reported"], expected) == nil
+	})
+	if c, ok := s.Container("reported"); !ok || c.Config.Image != "test/other" {
+		t.Error("Reported service was redeployed")
+	}
+
+	statuses, err := d.Services(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.Name == "reported" {
+			if diff := deep.Equal(status.Drift, expected); diff != nil {
+				t.Error(diff)
+			}
+		}
+	}
+
+	// Rollbacks are kept when repairing drift
+	job, err := d.Rollback("repaired", "v0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	c, ok = s.Container("repaired")
+	if !ok || c.Config.Labels[deploy.ImageLabel] != "test/test1:v0" {
+		t.Fatal("Service was not rolled back")
+	}
+	repairedID, repairedAt = c.ID, *deployed("repaired")
+	err = client.StopContainer(repairedID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually("Stopped container was not repaired", func() bool {
+		t := deployed("repaired")
+		return t != nil && t.After(repairedAt)
+	})
+	c, ok = s.Container("repaired")
+	if !ok || c.ID == repairedID {
+		t.Fatal("Stopped container was not replaced")
+	}
+	if image := c.Config.Labels[deploy.ImageLabel]; image != "test/test1:v0" {
+		t.Errorf("Got image %q after repair, expected %q", image, "test/test1:v0")
+	}
+	eventually("Rolled back service is reported as drifted", func() bool {
+		_, ok := d.Drift()["repaired"]
+		return !ok
+	})
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileDrift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		waitForJob(t, d, job.ID)
+		if sliceContains(job.Services, "repaired") {
+			t.Error("Rolled back service was reconciled")
+		}
+	}
+
+	// Redeploying ends the rollback
+	job, err = d.Redeploy("repaired", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	c, ok = s.Container("repaired")
+	if !ok || c.Config.Labels[deploy.ImageLabel] == "test/test1:v0" || c.Config.Labels[deploy.PinnedLabel] != "" {
+		t.Error("Redeployed service still runs the rollback image")
+	}
+}
+
+func TestReload(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:  "changed",
+			Image: "test/test1",
+		},
+		{
+			Name:  "removed",
+			Image: "test/test2",
+		},
+		{
+			Name:  "unchanged",
+			Image: "test/test1",
+		},
+	})
+	defer s.Close()
+	defer d.Close()
+
+	foo := "bar"
+	changes, err := d.Reload(&config.Config{
+		Services: []config.Service{
+			{
+				Name:  "added",
+				Image: "test/test3",
+			},
+			{
+				Name:        "changed",
+				Image:       "test/test1",
+				Environment: types.MappingWithEquals{"FOO": &foo},
+			},
+			{
+				Name:  "unchanged",
+				Image: "test/test1",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := deploy.Changes{
+		Added:   []string{"added"},
+		Removed: []string{"removed"},
+		Changed: []string{"changed"},
+	}
+	if diff := deep.Equal(changes, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	_, err = d.Enqueue(deploy.Push{Repository: "test/test2", Tag: "latest"}, nil)
+	if err != deploy.ErrNoServices {
+		t.Errorf("Got error %v, expected %v", err, deploy.ErrNoServices)
+	}
+	_, err = d.Redeploy("removed", nil)
+	if err != deploy.ErrUnknownService {
+		t.Errorf("Got error %v, expected %v", err, deploy.ErrUnknownService)
+	}
+	job, err := d.Enqueue(deploy.Push{Repository: "test/test1", Tag: "latest"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if diff := deep.Equal(job.Services, []string{"changed", "unchanged"}); diff != nil {
+		t.Error(diff)
+	}
+	c, ok := s.Container("changed")
+	if !ok || !sliceContains(c.Config.Env, "FOO=bar") {
+		t.Error("Changed service was not deployed with new configuration")
+	}
+
+	// Invalid configurations are not swapped in
+	_, err = d.Reload(&config.Config{
+		Services: []config.Service{{
+			Name:    "invalid",
+			Image:   "test/test1",
+			Devices: []string{"/dev/null"},
+		}},
+	})
+	if err == nil {
+		t.Fatal("Expected error for invalid configuration")
+	}
+	_, err = d.Redeploy("added", nil)
+	if err != nil {
+		t.Errorf("Configuration was replaced: %v", err)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := deploy.New(&config.Config{
+		Config: types.Config{
+			Version: "3.5",
+			Networks: map[string]types.NetworkConfig{
+				"backend": {
+					Name:       "app-backend",
+					Driver:     "bridge",
+					DriverOpts: map[string]string{"com.docker.network.bridge.enable_icc": "true"},
+					Ipam: types.IPAMConfig{
+						Config: []*types.IPAMPool{{Subnet: "172.28.0.0/16"}},
+					},
+					Internal: true,
+				},
+				"frontend": {
+					External: types.External{External: true, Name: "shared"},
+				},
+			},
+		},
+		Services: []config.Service{{
+			Name:  "test",
+			Image: "test/test1",
+			Networks: map[string]*types.ServiceNetworkConfig{
+				"backend": {
+					Ipv4Address: "172.28.0.10",
+				},
+				"frontend": {
+					Aliases: []string{"web"},
+				},
+				"proxy": nil,
+			},
+		}},
+	}, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Networks that aren't declared already exist
+	s.AddNetwork("proxy")
+
+	// External networks are never created
+	job, err := d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateFailed {
+		t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if len(job.Errors) != 1 || !strings.Contains(job.Errors[0].Error, "external network shared does not exist") {
+		t.Errorf("Unexpected errors: %+v", job.Errors)
+	}
+	if _, ok := s.Network("shared"); ok {
+		t.Error("External network was created")
+	}
+
+	s.AddNetwork("shared")
+	job, err = d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+
+	n, ok := s.Network("app-backend")
+	if !ok {
+		t.Fatal("Network was not created")
+	}
+	if n.Driver != "bridge" || !n.Internal || n.Options["com.docker.network.bridge.enable_icc"] != "true" {
+		t.Errorf("Network created with wrong options: %+v", n)
+	}
+	if len(n.IPAM.Config) != 1 || n.IPAM.Config[0].Subnet != "172.28.0.0/16" {
+		t.Errorf("Got IPAM %+v, expected subnet 172.28.0.0/16", n.IPAM)
+	}
+
+	c, ok := s.Container("test")
+	if !ok {
+		t.Fatal("Container was not created")
+	}
+	if c.HostConfig.NetworkMode != "app-backend" {
+		t.Errorf("Got network mode %q, expected %q", c.HostConfig.NetworkMode, "app-backend")
+	}
+	if ip := c.NetworkSettings.Networks["app-backend"].IPAddress; ip != "172.28.0.10" {
+		t.Errorf("Got IP address %q, expected %q", ip, "172.28.0.10")
+	}
+	if diff := deep.Equal(c.NetworkSettings.Networks["shared"].Aliases, []string{"web"}); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := c.NetworkSettings.Networks["proxy"]; !ok {
+		t.Error("Container was not connected to undeclared network")
+	}
+
+	// The container is in all networks of the service
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileDrift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Got %d jobs, expected none", len(jobs))
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := deploy.New(&config.Config{
+		Config: types.Config{
+			Version: "3.5",
+			Volumes: map[string]types.VolumeConfig{
+				"data": {
+					Name:       "app-data",
+					Driver:     "local",
+					DriverOpts: map[string]string{"type": "tmpfs", "device": "tmpfs"},
+					Labels:     types.Labels{"app": "test"},
+				},
+				"cache": {
+					Name:     "cache",
+					External: types.External{External: true},
+				},
+			},
+		},
+		Services: []config.Service{{
+			Name:  "test",
+			Image: "test/test1",
+			Volumes: []types.ServiceVolumeConfig{
+				{
+					Type:   "volume",
+					Source: "data",
+					Target: "/data",
+				},
+				{
+					Type:        "volume",
+					Source:      "cache",
+					Target:      "/cache",
+					Consistency: "cached",
+				},
+				{
+					Type:   "volume",
+					Source: "logs",
+					Target: "/logs",
+				},
+			},
+		}},
+	}, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// External volumes are never created
+	job, err := d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateFailed {
+		t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if len(job.Errors) != 1 || !strings.Contains(job.Errors[0].Error, "external volume cache does not exist") {
+		t.Errorf("Unexpected errors: %+v", job.Errors)
+	}
+	if _, ok := s.Volume("cache"); ok {
+		t.Error("External volume was created")
+	}
+
+	s.AddVolume("cache")
+	job, err = d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+
+	v, ok := s.Volume("app-data")
+	if !ok {
+		t.Fatal("Volume was not created")
+	}
+	if v.Driver != "local" || v.Labels["app"] != "test" {
+		t.Errorf("Volume created with wrong options: %+v", v)
+	}
+	if diff := deep.Equal(s.VolumeOptions("app-data"), map[string]string{"type": "tmpfs", "device": "tmpfs"}); diff != nil {
+		t.Error(diff)
+	}
+
+	c, ok := s.Container("test")
+	if !ok {
+		t.Fatal("Container was not created")
+	}
+	mounts := []docker.HostMount{
+		{
+			Source: "app-data",
+			Target: "/data",
+			Type:   "volume",
+		},
+		{
+			Source: "logs",
+			Target: "/logs",
+			Type:   "volume",
+		},
+	}
+	if diff := deep.Equal(c.HostConfig.Mounts, mounts); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(c.HostConfig.Binds, []string{"cache:/cache:cached"}); diff != nil {
+		t.Error(diff)
+	}
+	// Volumes that aren't declared are created by Docker
+	if _, ok := s.Volume("logs"); !ok {
+		t.Error("Undeclared volume was not created")
+	}
+
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileDrift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Got %d jobs, expected none", len(jobs))
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	apiKey := filepath.Join(dir, "api_key")
+	err = ioutil.WriteFile(apiKey, []byte("supersecret1"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Unsetenv("TEST_APP_CONF")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	logger.Level = logrus.DebugLevel
+
+	// Only root can give files away
+	uid, gid := 100, 101
+	if os.Getuid() != 0 {
+		uid, gid = os.Getuid(), os.Getgid()
+	}
+	mode := uint32(0400)
+	hostDir := filepath.Join(dir, "host")
+	d, err := deploy.New(&config.Config{
+		Config: types.Config{
+			Version: "3.5",
+			Secrets: map[string]types.SecretConfig{
+				"api_key": {File: apiKey},
+			},
+			Configs: map[string]types.ConfigObjConfig{
+				"app_conf": {
+					External: types.External{External: true},
+					Labels:   types.Labels{config.EnvLabel: "TEST_APP_CONF"},
+				},
+			},
+		},
+		Services: []config.Service{{
+			Name:     "test",
+			Image:    "test/test1",
+			ReadOnly: true,
+			Secrets: []types.ServiceSecretConfig{{
+				Source: "api_key",
+			}},
+			Configs: []types.ServiceConfigObjConfig{{
+				Source: "app_conf",
+				Target: "/etc/app.conf",
+				UID:    strconv.Itoa(uid),
+				GID:    strconv.Itoa(gid),
+				Mode:   &mode,
+			}},
+		}},
+	}, deploy.WithMonitor(50*time.Millisecond), deploy.WithLogger(logger), deploy.WithSecretsDir(hostDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Environment variables have to be set, and the existing
+	// container is kept running if they aren't
+	s.AddImage("test/test1")
+	oldID := s.AddContainer("test", "test/test1")
+	job, err := d.Redeploy("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateFailed {
+		t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if len(job.Errors) != 1 || !strings.Contains(job.Errors[0].Error, "environment variable TEST_APP_CONF of config app_conf is not set") {
+		t.Errorf("Unexpected errors: %+v", job.Errors)
+	}
+	if c, ok := s.Container("test"); !ok || c.ID != oldID || !c.State.Running {
+		t.Error("Existing container was not kept running")
+	}
+
+	err = os.Setenv("TEST_APP_CONF", "supersecret2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("TEST_APP_CONF")
+
+	for _, secret := range []string{"supersecret1", "supersecret3"} {
+		err = ioutil.WriteFile(apiKey, []byte(secret), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		job, err = d.Redeploy("test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+
+		// Secrets are read-only and owned by the user of redeploy by default
+		f, ok := s.File("test", "/run/secrets/api_key")
+		if !ok {
+			t.Fatal("Secret was not mounted")
+		}
+		if diff := deep.Equal(f, dockertest.File{Content: []byte(secret), UID: os.Getuid(), GID: os.Getgid(), Mode: 0444}); diff != nil {
+			t.Error(diff)
+		}
+
+		f, ok = s.File("test", "/etc/app.conf")
+		if !ok {
+			t.Fatal("Config was not mounted")
+		}
+		if diff := deep.Equal(f, dockertest.File{Content: []byte("supersecret2"), UID: uid, GID: gid, Mode: 0400}); diff != nil {
+			t.Error(diff)
+		}
+	}
+
+	// Files are bind-mounted read-only, not copied into the container
+	c, ok := s.Container("test")
+	if !ok {
+		t.Fatal("Service container does not exist")
+	}
+	var targets []string
+	for _, m := range c.HostConfig.Mounts {
+		if m.Type != "bind" || !m.ReadOnly || !strings.HasPrefix(m.Source, hostDir) {
+			t.Errorf("Unexpected mount %+v", m)
+		}
+		targets = append(targets, m.Target)
+	}
+	if diff := deep.Equal(targets, []string{"/run/secrets/api_key", "/etc/app.conf"}); diff != nil {
+		t.Error(diff)
+	}
+	for _, call := range s.Calls() {
+		if strings.HasSuffix(call, "/archive") {
+			t.Errorf("Unexpected call %s", call)
+		}
+	}
+	info, err := os.Stat(filepath.Join(hostDir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("Got mode %v of secrets directory, expected %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+
+	if strings.Contains(logs.String(), "supersecret") {
+		t.Error("Secret was logged")
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:      "app",
+			Image:     "test/app",
+			DependsOn: []string{"db"},
+			Labels:    types.Labels{config.RestartDependentsLabel: "true"},
+		},
+		{
+			Name:  "db",
+			Image: "test/db",
+		},
+		{
+			Name:      "sidecar",
+			Image:     "test/sidecar",
+			DependsOn: []string{"app"},
+		},
+	}, deploy.WithWorkers(3))
+	defer s.Close()
+	defer d.Close()
+
+	// Services are deployed after their dependencies,
+	// even with enough workers to deploy all at once
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileMissing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := map[string]time.Time{}
+	var services []string
+	for _, job := range jobs {
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Errorf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+		services = append(services, job.Services...)
+		finished[job.Services[0]] = job.Updated
+	}
+	if diff := deep.Equal(services, []string{"db", "app", "sidecar"}); diff != nil {
+		t.Error(diff)
+	}
+	for service, dep := range map[string]string{"app": "db", "sidecar": "app"} {
+		c, ok := s.Container(service)
+		if !ok {
+			t.Fatalf("Service %s was not deployed", service)
+		}
+		if c.Created.Before(finished[dep]) {
+			t.Errorf("Service %s was deployed before %s", service, dep)
+		}
+	}
+
+	// Deploying app restarts sidecar
+	sidecar, _ := s.Container("sidecar")
+	job, err := d.Redeploy("app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	if diff := deep.Equal(job.Restarted, []string{"sidecar"}); diff != nil {
+		t.Error(diff)
+	}
+	c, _ := s.Container("sidecar")
+	if c.ID != sidecar.ID {
+		t.Error("Dependent service was recreated")
+	}
+	if !c.State.Running || !c.State.StartedAt.After(sidecar.State.StartedAt) {
+		t.Error("Dependent service was not restarted")
+	}
+
+	// Deploying db doesn't restart app, as db doesn't opt in
+	app, _ := s.Container("app")
+	job, err = d.Redeploy("db", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, d, job.ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	if len(job.Restarted) != 0 {
+		t.Errorf("Got restarted services %v, expected none", job.Restarted)
+	}
+	if c, _ := s.Container("app"); !c.State.StartedAt.Equal(app.State.StartedAt) {
+		t.Error("Service was restarted without opting in")
+	}
+}
+
+func TestSupersededDependency(t *testing.T) {
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:      "app",
+			Image:     "test/app",
+			DependsOn: []string{"db"},
+		},
+		{
+			Name:  "db",
+			Image: "test/db",
+		},
+	}, deploy.WithWorkers(2), deploy.WithDebounce(100*time.Millisecond))
+	defer s.Close()
+	defer d.Close()
+
+	redeploy := func(name string) deploy.Job {
+		t.Helper()
+		job, err := d.Redeploy(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+
+	// The job app waits for is superseded while
+	// debouncing, so app waits for the newer job
+	first := redeploy("db")
+	app := redeploy("app")
+	second := redeploy("db")
+
+	if job := waitForJob(t, d, first.ID); job.State != deploy.StateSuperseded {
+		t.Errorf("Got state %q, expected %q", job.State, deploy.StateSuperseded)
+	}
+	db := waitForJob(t, d, second.ID)
+	if db.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", db.State, deploy.StateSucceeded, db.Errors)
+	}
+	if job := waitForJob(t, d, app.ID); job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	c, ok := s.Container("app")
+	if !ok {
+		t.Fatal("Service app was not deployed")
+	}
+	if c.Created.Before(db.Updated) {
+		t.Error("Service app was deployed before db")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parallelism := uint64(2)
+	newConfig := func(replicas uint64) *config.Config {
+		return &config.Config{
+			Config: types.Config{
+				Version: "3.0",
+			},
+			Services: []config.Service{{
+				Name:   "web",
+				Image:  "test/test1",
+				Labels: types.Labels{config.RangePortsLabel: "true"},
+				Ports: []types.ServicePortConfig{{
+					Published: 8080,
+					Target:    80,
+					Protocol:  "tcp",
+				}},
+				Deploy: types.DeployConfig{
+					Replicas: &replicas,
+					UpdateConfig: &types.UpdateConfig{
+						Parallelism: &parallelism,
+						Delay:       200 * time.Millisecond,
+					},
+				},
+			}},
+		}
+	}
+
+	d, err := deploy.New(newConfig(3), deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The container named after the service is replaced by replicas
+	s.AddImage("test/test1")
+	s.AddContainer("web", "test/test1")
+
+	redeploy := func(expected ...string) {
+		t.Helper()
+		job, err := d.Redeploy("web", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+		names := s.Containers()
+		sort.Strings(names)
+		if diff := deep.Equal(names, expected); diff != nil {
+			t.Error(diff)
+		}
+	}
+	redeploy("web_1", "web_2", "web_3")
+
+	// Replicas are updated two at a time, with a delay in between
+	var created []time.Time
+	for i, name := range []string{"web_1", "web_2", "web_3"} {
+		c, _ := s.Container(name)
+		created = append(created, c.Created)
+		port := c.HostConfig.PortBindings["80/tcp"][0].HostPort
+		if port != strconv.Itoa(8080+i) {
+			t.Errorf("Got port %s for %s, expected %d", port, name, 8080+i)
+		}
+	}
+	if created[1].Sub(created[0]) >= 200*time.Millisecond {
+		t.Error("Replicas of the same batch were not updated at once")
+	}
+	if created[2].Sub(created[0]) < 200*time.Millisecond {
+		t.Error("Replicas were updated without delay between batches")
+	}
+
+	statuses, err := d.Services(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].Replicas != "3/3" || statuses[0].State != "running" {
+		t.Errorf("Unexpected status: %+v", statuses[0])
+	}
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileDrift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Got %d jobs, expected none", len(jobs))
+	}
+
+	// Scale down
+	_, err = d.Reload(newConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	redeploy("web_1", "web_2")
+
+	// Scale up
+	_, err = d.Reload(newConfig(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = d.Reconcile(context.Background(), deploy.ReconcileMissing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Got %d jobs, expected 1", len(jobs))
+	}
+	job := waitForJob(t, d, jobs[0].ID)
+	if job.State != deploy.StateSucceeded {
+		t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+	}
+	names := s.Containers()
+	sort.Strings(names)
+	if diff := deep.Equal(names, []string{"web_1", "web_2", "web_3", "web_4"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestReplicaNames(t *testing.T) {
+	// Services named like the replicas of another service are only
+	// rejected when the configuration is loaded
+	d, s := newDeployer(t, []config.Service{
+		{
+			Name:  "web",
+			Image: "test/test1",
+		},
+		{
+			Name:  "web_2",
+			Image: "test/test2",
+		},
+	})
+	defer s.Close()
+	defer d.Close()
+
+	redeploy := func(name string) {
+		t.Helper()
+		job, err := d.Redeploy(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateSucceeded {
+			t.Fatalf("Got state %q, expected %q: %v", job.State, deploy.StateSucceeded, job.Errors)
+		}
+	}
+	redeploy("web_2")
+	other, ok := s.Container("web_2")
+	if !ok {
+		t.Fatal("Container was not created")
+	}
+
+	// The container of the other service is not a surplus replica
+	redeploy("web")
+	if c, ok := s.Container("web_2"); !ok || c.ID != other.ID {
+		t.Error("Container of other service was removed")
+	}
+	jobs, err := d.Reconcile(context.Background(), deploy.ReconcileDrift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Got %d jobs, expected none", len(jobs))
+	}
+}
+
+func TestReplicaFailures(t *testing.T) {
+	for _, testCase := range []struct {
+		Action config.FailureAction
+		// Replaced lists the replicas replaced by new containers
+		Replaced []string
+	}{
+		{config.FailurePause, []string{"web_1"}},
+		{config.FailureContinue, []string{"web_1", "web_2", "web_3"}},
+	} {
+		t.Run(string(testCase.Action), func(t *testing.T) {
+			replicas := uint64(3)
+			d, s := newDeployer(t, []config.Service{{
+				Name:  "web",
+				Image: "test/test1:v2",
+				Deploy: types.DeployConfig{
+					Replicas: &replicas,
+					UpdateConfig: &types.UpdateConfig{
+						FailureAction: string(testCase.Action),
+					},
+				},
+			}})
+			defer s.Close()
+			defer d.Close()
+
+			v1 := s.AddImage("test/test1:v1")
+			ids := map[string]string{}
+			for _, name := range []string{"web_1", "web_2", "web_3"} {
+				ids[name] = s.AddContainer(name, "test/test1:v1")
+			}
+			s.SetExitCode("test/test1:v2", 1)
+
+			job, err := d.Redeploy("web", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job = waitForJob(t, d, job.ID)
+			if job.State != deploy.StateFailed {
+				t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+			}
+
+			// Failed replicas are rolled back
+			for name, id := range ids {
+				c, ok := s.Container(name)
+				if !ok || !c.State.Running || c.Image != v1 {
+					t.Errorf("Replica %s is not running the previous image", name)
+				}
+				if replaced := c.ID != id; replaced != sliceContains(testCase.Replaced, name) {
+					t.Errorf("Got replaced %t for %s", replaced, name)
+				}
+			}
+		})
+	}
+
+	t.Run(string(config.FailureRollback), func(t *testing.T) {
+		replicas := uint64(2)
+		d, s := newDeployer(t, []config.Service{{
+			Name:  "web",
+			Image: "test/test1:v2",
+			Deploy: types.DeployConfig{
+				Replicas: &replicas,
+				UpdateConfig: &types.UpdateConfig{
+					Delay:         500 * time.Millisecond,
+					FailureAction: string(config.FailureRollback),
+				},
+			},
+		}})
+		defer s.Close()
+		defer d.Close()
+
+		v1 := s.AddImage("test/test1:v1")
+		for _, name := range []string{"web_1", "web_2"} {
+			s.AddContainer(name, "test/test1:v1")
+		}
+
+		job, err := d.Redeploy("web", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Fail the second replica once the first is updated
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c, ok := s.Container("web_1")
+			if ok && c.Config.Labels[deploy.ImageLabel] == "test/test1:v2" && c.State.Running {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for first replica")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		s.Fail("POST /containers/create", 1)
+
+		job = waitForJob(t, d, job.ID)
+		if job.State != deploy.StateFailed {
+			t.Fatalf("Got state %q, expected %q", job.State, deploy.StateFailed)
+		}
+		if job.RolledBack["web"] != v1 {
+			t.Errorf("Got rolled back %v, expected web to be rolled back to %s", job.RolledBack, v1)
+		}
+		for _, name := range []string{"web_1", "web_2"} {
+			c, ok := s.Container(name)
+			if !ok || !c.State.Running || c.Image != v1 {
+				t.Errorf("Replica %s is not running the previous image", name)
+			}
+		}
+	})
+}
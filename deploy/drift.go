@@ -0,0 +1,237 @@
+package deploy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// Drift describes a setting of a container that differs
+// from the configuration of its service.
+type Drift struct {
+	// Container is the container of the replica
+	// that drifted, for services with replicas.
+	Container string `json:"container,omitempty"`
+	Field     string `json:"field"`
+	Want      string `json:"want"`
+	Have      string `json:"have"`
+}
+
+func (d Drift) String() string {
+	have := d.Have
+	if have == "" {
+		have = "none"
+	}
+	if d.Container != "" {
+		return fmt.Sprintf("%s: %s: want %s, have %s", d.Container, d.Field, d.Want, have)
+	}
+	return fmt.Sprintf("%s: want %s, have %s", d.Field, d.Want, have)
+}
+
+// fields returns the drift as log fields.
+func (d Drift) fields() logrus.Fields {
+	fields := logrus.Fields{
+		"field": d.Field,
+		"want":  d.Want,
+		"have":  d.Have,
+	}
+	if d.Container != "" {
+		fields["container"] = d.Container
+	}
+	return fields
+}
+
+// containerDrift compares the container of the replica of the
+// service to the options it would be created with. Settings that
+// Docker fills in from the image or with defaults, such as the
+// environment and labels of the image, are not reported as drift.
+func (d *Deployer) containerDrift(service config.Service, replica int, c *docker.Container) []Drift {
+	// Error is checked on startup, can't error now.
+	want, _ := service.ReplicaContainerOptions(replica)
+	idx := d.index()
+	idx.networkOptions(&want)
+	idx.volumeOptions(&want)
+	d.fileOptions(service, &want)
+	config, hostConfig := c.Config, c.HostConfig
+	if config == nil {
+		config = &docker.Config{}
+	}
+	if hostConfig == nil {
+		hostConfig = &docker.HostConfig{}
+	}
+
+	container := replicaName(service, want.Name)
+	var drift []Drift
+	add := func(field, want, have string) {
+		if want != have {
+			drift = append(drift, Drift{Container: container, Field: field, Want: want, Have: have})
+		}
+	}
+
+	add("image", service.Image, d.imageDrift(service, config))
+	wantEnv, haveEnv := missing(want.Config.Env, config.Env)
+	add("environment", wantEnv, haveEnv)
+	wantLabels, haveLabels := missing(labelList(want.Config.Labels), labelList(config.Labels))
+	add("labels", wantLabels, haveLabels)
+	if len(want.Config.Cmd) > 0 {
+		add("command", strings.Join(want.Config.Cmd, " "), strings.Join(config.Cmd, " "))
+	}
+	if len(want.Config.Entrypoint) > 0 {
+		add("entrypoint", strings.Join(want.Config.Entrypoint, " "), strings.Join(config.Entrypoint, " "))
+	}
+	if want.Config.User != "" {
+		add("user", want.Config.User, config.User)
+	}
+	if want.Config.WorkingDir != "" {
+		add("working_dir", want.Config.WorkingDir, config.WorkingDir)
+	}
+	if want.Config.Hostname != "" {
+		add("hostname", want.Config.Hostname, config.Hostname)
+	}
+	if want.Config.Healthcheck != nil {
+		var test []string
+		if config.Healthcheck != nil {
+			test = config.Healthcheck.Test
+		}
+		add("healthcheck", strings.Join(want.Config.Healthcheck.Test, " "), strings.Join(test, " "))
+	}
+
+	add("ports", portList(want.HostConfig.PortBindings), portList(hostConfig.PortBindings))
+	add("volumes", mountList(want.HostConfig.Mounts, want.HostConfig.Binds), mountList(hostConfig.Mounts, hostConfig.Binds))
+	add("restart", restartPolicy(want.HostConfig.RestartPolicy), restartPolicy(hostConfig.RestartPolicy))
+	add("network_mode", networkMode(want.HostConfig.NetworkMode), networkMode(hostConfig.NetworkMode))
+	if len(service.Networks) > 0 {
+		var wantNetworks, haveNetworks []string
+		for key := range service.Networks {
+			wantNetworks = append(wantNetworks, idx.networkName(key))
+		}
+		if c.NetworkSettings != nil {
+			for name := range c.NetworkSettings.Networks {
+				haveNetworks = append(haveNetworks, name)
+			}
+		}
+		add("networks", sortedList(wantNetworks), sortedList(haveNetworks))
+	}
+	add("privileged", strconv.FormatBool(want.HostConfig.Privileged), strconv.FormatBool(hostConfig.Privileged))
+	add("read_only", strconv.FormatBool(want.HostConfig.ReadonlyRootfs), strconv.FormatBool(hostConfig.ReadonlyRootfs))
+	add("cap_add", sortedList(want.HostConfig.CapAdd), sortedList(hostConfig.CapAdd))
+	add("cap_drop", sortedList(want.HostConfig.CapDrop), sortedList(hostConfig.CapDrop))
+	add("memory", strconv.FormatInt(want.HostConfig.Memory, 10), strconv.FormatInt(hostConfig.Memory, 10))
+
+	return drift
+}
+
+// imageDrift returns the configured image of the service if the
+// container runs it, or else the image the container runs.
+// Services with a tag policy, and services that were rolled
+// back, may run any image of the repository.
+func (d *Deployer) imageDrift(service config.Service, c *docker.Config) string {
+	have := c.Image
+	if image, ok := c.Labels[ImageLabel]; ok {
+		// Containers are created from the digest
+		have = image
+	}
+	wantRepo, wantTag, wantDigest := parseImage(service.Image)
+	haveRepo, haveTag, haveDigest := parseImage(have)
+	if digest, ok := c.Labels[DigestLabel]; ok {
+		haveDigest = digest
+	}
+
+	switch {
+	case wantRepo != haveRepo:
+	case c.Labels[PinnedLabel] == "true":
+		return service.Image
+	case wantDigest != "":
+		if wantDigest == haveDigest {
+			return service.Image
+		}
+	case d.index().policies[service.Name] != nil, wantTag == haveTag:
+		return service.Image
+	}
+	return have
+}
+
+// missing returns the KEY=value entries of want not in have,
+// and the entries of have with the same keys.
+func missing(want, have []string) (string, string) {
+	var w, h []string
+	for _, entry := range want {
+		if sliceContains(have, entry) {
+			continue
+		}
+		w = append(w, entry)
+		key := strings.SplitN(entry, "=", 2)[0] + "="
+		for _, other := range have {
+			if strings.HasPrefix(other, key) {
+				h = append(h, other)
+			}
+		}
+	}
+	return sortedList(w), sortedList(h)
+}
+
+func labelList(labels map[string]string) []string {
+	var list []string
+	for k, v := range labels {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func portList(bindings map[docker.Port][]docker.PortBinding) string {
+	var list []string
+	for port, binding := range bindings {
+		for _, b := range binding {
+			host := b.HostPort
+			if b.HostIP != "" {
+				host = b.HostIP + ":" + host
+			}
+			list = append(list, host+":"+string(port))
+		}
+	}
+	return sortedList(list)
+}
+
+func mountList(mounts []docker.HostMount, binds []string) string {
+	list := append([]string(nil), binds...)
+	for _, m := range mounts {
+		s := m.Type + ":" + m.Source + ":" + m.Target
+		if m.ReadOnly {
+			s += ":ro"
+		}
+		list = append(list, s)
+	}
+	return sortedList(list)
+}
+
+func restartPolicy(p docker.RestartPolicy) string {
+	name := p.Name
+	if name == "" {
+		name = "no"
+	}
+	if p.MaximumRetryCount > 0 {
+		name += ":" + strconv.Itoa(p.MaximumRetryCount)
+	}
+	return name
+}
+
+func networkMode(mode string) string {
+	if mode == "" || mode == "bridge" {
+		// Docker uses the bridge network by default
+		return "default"
+	}
+	return mode
+}
+
+func sortedList(list []string) string {
+	list = append([]string(nil), list...)
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,103 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// healthInterval is how often the state of a
+// new container is inspected.
+var healthInterval = 500 * time.Millisecond
+
+// WithHealthTimeout configures how long to wait for a new
+// container to report itself healthy before the deploy is
+// considered failed. Defaults to 2 minutes.
+func WithHealthTimeout(t time.Duration) DeployerOption {
+	return func(d *Deployer) {
+		d.healthTimeout = t
+	}
+}
+
+// WithMonitor configures how long a new container without
+// a health check has to keep running before the deploy is
+// considered successful. It can be overridden per service with
+// deploy.update_config.monitor. Defaults to 5 seconds.
+func WithMonitor(t time.Duration) DeployerOption {
+	return func(d *Deployer) {
+		d.monitor = t
+	}
+}
+
+// waitHealthy waits for the container to report itself healthy.
+// Containers without a health check are considered healthy once
+// they have been running for the monitor duration of the service.
+// Containers that exit, restart, report themselves unhealthy or
+// don't become healthy within the health timeout are considered failed.
+func (d *Deployer) waitHealthy(ctx context.Context, service config.Service, id string, logger *logrus.Entry) error {
+	ctx, cancel := context.WithTimeout(ctx, d.healthTimeout)
+	defer cancel()
+
+	monitor := d.monitor
+	if uc := service.Deploy.UpdateConfig; uc != nil && uc.Monitor > 0 {
+		monitor = uc.Monitor
+	}
+
+	logger = logger.WithField("id", id)
+	for {
+		c, err := d.client.InspectContainerWithContext(id, ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.Errorf("timed out after %v waiting for container to become healthy", d.healthTimeout)
+			}
+			return errors.Wrap(err, "failed to inspect container")
+		}
+
+		wait := healthInterval
+		switch {
+		case !c.State.Running:
+			return errors.Errorf("container exited with code %d%s", c.State.ExitCode, lastHealthCheck(c))
+		case c.RestartCount > 0:
+			return errors.Errorf("container restarted %d times%s", c.RestartCount, lastHealthCheck(c))
+		case c.State.Health.Status == "healthy":
+			logger.Debug("Container is healthy")
+			return nil
+		case c.State.Health.Status == "unhealthy":
+			return errors.Errorf("container is unhealthy%s", lastHealthCheck(c))
+		case c.State.Health.Status == "":
+			// No health check, check that it keeps running
+			running := time.Since(c.State.StartedAt)
+			if running >= monitor {
+				logger.WithField("running", running).Debug("Container is running")
+				return nil
+			}
+			if monitor-running < wait {
+				wait = monitor - running
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errors.Errorf("timed out after %v waiting for container to become healthy%s", d.healthTimeout, lastHealthCheck(c))
+		}
+	}
+}
+
+// lastHealthCheck formats the result of the last health check
+// of the container for inclusion in an error message.
+func lastHealthCheck(c *docker.Container) string {
+	logs := c.State.Health.Log
+	if len(logs) == 0 {
+		return ""
+	}
+	last := logs[len(logs)-1]
+	return fmt.Sprintf(": last health check exited with code %d: %s", last.ExitCode, strings.TrimSpace(last.Output))
+}
@@ -0,0 +1,58 @@
+package deploy
+
+import (
+	"strings"
+
+	"github.com/johanbrandhorst/redeploy/history"
+)
+
+// records returns the history records of the finished job,
+// one for each service it attempted to deploy.
+func records(job Job) []history.Record {
+	digest := job.Digest
+	if digest == "" {
+		digest = job.Push.Digest
+	}
+
+	var steps []history.Step
+	for _, step := range job.Steps {
+		steps = append(steps, history.Step{
+			Name: string(step.State),
+			Time: step.Time,
+		})
+	}
+
+	var records []history.Record
+	for _, service := range job.Services {
+		r := history.Record{
+			Job:        job.ID,
+			Service:    service,
+			Image:      job.Push.Image(),
+			Repository: job.Push.Repository,
+			Tag:        job.Push.Tag,
+			Digest:     digest,
+			Pusher:     job.Push.Pusher,
+			Outcome:    string(StateSucceeded),
+			RolledBack: job.RolledBack[service],
+			Steps:      steps,
+			Started:    job.Created,
+			Finished:   job.Updated,
+		}
+
+		var errs []string
+		for _, err := range job.Errors {
+			// Errors without a service apply to all services
+			if err.Service == "" || err.Service == service {
+				errs = append(errs, err.Error)
+			}
+		}
+		if len(errs) > 0 {
+			r.Outcome = string(StateFailed)
+			r.Error = strings.Join(errs, "; ")
+		}
+
+		records = append(records, r)
+	}
+
+	return records
+}
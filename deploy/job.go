@@ -0,0 +1,212 @@
+package deploy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// State describes the progress of a Job.
+type State string
+
+// Possible job states.
+const (
+	StateQueued    State = "queued"
+	StatePulling   State = "pulling"
+	StateReplacing State = "replacing"
+	// StateRollingBack is used while a service is recreated
+	// from its previous image after a failed deploy.
+	StateRollingBack State = "rolling-back"
+	StateSucceeded   State = "succeeded"
+	StateFailed      State = "failed"
+	// StateSuperseded is used for jobs where every service
+	// was taken over by a job for a newer push.
+	StateSuperseded State = "superseded"
+)
+
+// Done returns true if the state is final.
+func (s State) Done() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateSuperseded
+}
+
+// Push describes an image that was pushed to a registry.
+type Push struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Pusher     string `json:"pusher,omitempty"`
+}
+
+// Image returns the image reference of the push.
+func (p Push) Image() string {
+	if p.Digest != "" {
+		return p.Repository + "@" + p.Digest
+	}
+	return p.Repository + ":" + p.Tag
+}
+
+// StepError records an error encountered during a step of a job.
+type StepError struct {
+	Service string `json:"service,omitempty"`
+	Step    State  `json:"step"`
+	Error   string `json:"error"`
+}
+
+// Step records when a job entered a state.
+type Step struct {
+	State State     `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// Job is a deployment of a pushed image to all
+// services configured to use it.
+type Job struct {
+	ID       string      `json:"id"`
+	Push     Push        `json:"push"`
+	Services []string    `json:"services"`
+	State    State       `json:"state"`
+	Errors   []StepError `json:"errors,omitempty"`
+	Created  time.Time   `json:"created"`
+	Updated  time.Time   `json:"updated"`
+	Steps    []Step      `json:"steps"`
+	// Digest is the digest of the pulled image.
+	Digest string `json:"digest,omitempty"`
+	// SupersededBy maps services that were removed from this job
+	// to the ID of the newer job that deploys them instead.
+	SupersededBy map[string]string `json:"superseded_by,omitempty"`
+	// RolledBack maps services that failed to deploy and were
+	// recreated from their previous image to the ID of that image.
+	RolledBack map[string]string `json:"rolled_back,omitempty"`
+	// Ignored maps services that were removed from this job because
+	// a newer tag under their tag policy is already deployed or queued
+	// to that tag.
+	Ignored map[string]string `json:"ignored,omitempty"`
+	// Restarted lists the services that were restarted because
+	// a service they depend on was deployed.
+	Restarted []string `json:"restarted,omitempty"`
+
+	services []config.Service
+	callback func(Job)
+	// image, if set, is used instead of the
+	// image configured for the services.
+	image string
+	// pinned is set for jobs rolling services back to
+	// another image than the one configured.
+	pinned bool
+	// ordered is set for jobs of pushes matched by tag policy,
+	// which are ignored for services where the pushed tag is
+	// older than the one deployed.
+	ordered bool
+	// after are the unfinished jobs deploying dependencies
+	// of the services when the job was queued, and the jobs
+	// that superseded them, which have to finish before
+	// the job is started.
+	after []*Job
+	// done is closed once the job has finished.
+	done chan struct{}
+}
+
+func newJob(push Push, services []config.Service, callback func(Job)) *Job {
+	now := time.Now()
+	job := &Job{
+		ID:       newJobID(),
+		Push:     push,
+		State:    StateQueued,
+		Created:  now,
+		Updated:  now,
+		Steps:    []Step{{State: StateQueued, Time: now}},
+		services: services,
+		callback: callback,
+		done:     make(chan struct{}),
+	}
+	for _, service := range services {
+		job.Services = append(job.Services, service.Name)
+	}
+	return job
+}
+
+// copy returns a copy of the job that is safe to
+// hand out while the original is being updated.
+func (j *Job) copy() Job {
+	c := *j
+	c.Services = append([]string(nil), j.Services...)
+	c.Errors = append([]StepError(nil), j.Errors...)
+	c.Steps = append([]Step(nil), j.Steps...)
+	c.SupersededBy = copyMap(j.SupersededBy)
+	c.RolledBack = copyMap(j.RolledBack)
+	c.Ignored = copyMap(j.Ignored)
+	c.Restarted = append([]string(nil), j.Restarted...)
+	c.services = nil
+	c.callback = nil
+	c.after = nil
+	c.done = nil
+	return c
+}
+
+// setState moves the job to the state, recording the step.
+func (j *Job) setState(state State) {
+	now := time.Now()
+	j.State = state
+	j.Updated = now
+	j.Steps = append(j.Steps, Step{State: state, Time: now})
+}
+
+// supersede removes the service from the job,
+// recording the job that took it over.
+func (j *Job) supersede(service string, by *Job) {
+	j.remove(service)
+	if j.SupersededBy == nil {
+		j.SupersededBy = map[string]string{}
+	}
+	j.SupersededBy[service] = by.ID
+}
+
+// ignore removes the service from the job,
+// recording the newer tag it follows instead.
+func (j *Job) ignore(service, tag string) {
+	j.remove(service)
+	if j.Ignored == nil {
+		j.Ignored = map[string]string{}
+	}
+	j.Ignored[service] = tag
+}
+
+// remove removes the service from the job.
+func (j *Job) remove(service string) {
+	for i, s := range j.services {
+		if s.Name == service {
+			j.services = append(j.services[:i:i], j.services[i+1:]...)
+			break
+		}
+	}
+	for i, s := range j.Services {
+		if s == service {
+			j.Services = append(j.Services[:i:i], j.Services[i+1:]...)
+			break
+		}
+	}
+	j.Updated = time.Now()
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read only fails if the system
+	// source of randomness is unavailable.
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,155 @@
+package deploy
+
+import (
+	"context"
+	"sort"
+
+	"github.com/docker/cli/cli/compose/types"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// networkName returns the name of the Docker network of
+// a network of the configuration, which defaults to its key.
+func networkName(key string, n types.NetworkConfig) string {
+	switch {
+	case n.External.External && n.External.Name != "":
+		return n.External.Name
+	case n.Name != "":
+		return n.Name
+	}
+	return key
+}
+
+// networkName returns the name of the Docker network of the
+// network of the configuration with the provided key. Networks
+// that aren't configured, such as bridge or host, keep their name.
+func (idx *serviceIndex) networkName(key string) string {
+	n, ok := idx.networks[key]
+	if !ok {
+		return key
+	}
+	return networkName(key, n)
+}
+
+// networkOptions renames the networks of the options from
+// their keys in the configuration to their Docker networks.
+func (idx *serviceIndex) networkOptions(cOpts *docker.CreateContainerOptions) {
+	if cOpts.HostConfig != nil {
+		switch mode := cOpts.HostConfig.NetworkMode; mode {
+		case "", "bridge", "host", "none":
+		default:
+			cOpts.HostConfig.NetworkMode = idx.networkName(mode)
+		}
+	}
+	if cOpts.NetworkingConfig == nil {
+		return
+	}
+	endpoints := make(map[string]*docker.EndpointConfig, len(cOpts.NetworkingConfig.EndpointsConfig))
+	for key, endpoint := range cOpts.NetworkingConfig.EndpointsConfig {
+		endpoints[idx.networkName(key)] = endpoint
+	}
+	cOpts.NetworkingConfig = &docker.NetworkingConfig{
+		EndpointsConfig: endpoints,
+	}
+}
+
+// ensureNetworks creates the networks of the service that don't
+// exist yet. External networks are never created, and an error is
+// returned if one of them doesn't exist.
+func (d *Deployer) ensureNetworks(ctx context.Context, service config.Service, logger *logrus.Entry) error {
+	d.networkMu.Lock()
+	defer d.networkMu.Unlock()
+
+	idx := d.index()
+	for _, key := range sortedKeys(service.NetworkEndpoints()) {
+		n, ok := idx.networks[key]
+		if !ok {
+			// Networks created by Docker, such as bridge
+			continue
+		}
+		name := networkName(key, n)
+
+		_, err := d.client.NetworkInfo(name)
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*docker.NoSuchNetwork); !ok {
+			return errors.Wrapf(err, "failed to inspect network %s", name)
+		}
+		if n.External.External {
+			return errors.Errorf("external network %s does not exist", name)
+		}
+
+		opts := docker.CreateNetworkOptions{
+			Name:           name,
+			Driver:         n.Driver,
+			Labels:         n.Labels,
+			Internal:       n.Internal,
+			CheckDuplicate: true,
+			Context:        ctx,
+		}
+		if len(n.DriverOpts) > 0 {
+			opts.Options = map[string]interface{}{}
+			for k, v := range n.DriverOpts {
+				opts.Options[k] = v
+			}
+		}
+		if n.Ipam.Driver != "" || len(n.Ipam.Config) > 0 {
+			opts.IPAM = &docker.IPAMOptions{
+				Driver: n.Ipam.Driver,
+			}
+			for _, pool := range n.Ipam.Config {
+				opts.IPAM.Config = append(opts.IPAM.Config, docker.IPAMConfig{
+					Subnet: pool.Subnet,
+				})
+			}
+		}
+		_, err = d.client.CreateNetwork(opts)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create network %s", name)
+		}
+		logger.WithField("network", name).Info("Created network")
+	}
+
+	return nil
+}
+
+// connectNetworks connects the container to the networks of
+// the service other than the one it was created in.
+func (d *Deployer) connectNetworks(ctx context.Context, service config.Service, id string, logger *logrus.Entry) error {
+	idx := d.index()
+	primary := service.PrimaryNetwork()
+	endpoints := service.NetworkEndpoints()
+	for _, key := range sortedKeys(endpoints) {
+		if key == primary {
+			continue
+		}
+		name := idx.networkName(key)
+		err := d.client.ConnectNetwork(name, docker.NetworkConnectionOptions{
+			Container:      id,
+			EndpointConfig: endpoints[key],
+			Context:        ctx,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to connect network %s", name)
+		}
+		logger.WithFields(logrus.Fields{
+			"id":      id,
+			"network": name,
+		}).Debug("Connected network")
+	}
+	return nil
+}
+
+func sortedKeys(endpoints map[string]*docker.EndpointConfig) []string {
+	keys := make([]string, 0, len(endpoints))
+	for key := range endpoints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package deploy
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/registry"
+)
+
+// WithPolling configures the Deployer to poll the registries of
+// the services for changes to their images. Every interval, plus a
+// random duration of up to jitter, the digest of the configured tag
+// of each service is compared to the digest of the image of its
+// container, and the service is redeployed if they differ.
+// Services that were rolled back are redeployed once another
+// digest is pushed to the tag after the rollback.
+// Services opt out of polling with the redeploy.poll label.
+// Services with a tag policy are not polled.
+func WithPolling(c *registry.Client, interval, jitter time.Duration) DeployerOption {
+	return func(d *Deployer) {
+		d.registry = c
+		d.pollInterval = interval
+		d.pollJitter = jitter
+	}
+}
+
+// poll polls the registries of the services until the Deployer is closed.
+func (d *Deployer) poll() {
+	defer d.wg.Done()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		wait := d.pollInterval
+		if d.pollJitter > 0 {
+			wait += time.Duration(rnd.Int63n(int64(d.pollJitter)))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-d.done:
+			return
+		}
+
+		idx := d.index()
+		for _, name := range idx.names {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			d.pollService(d.ctx, idx.services[name])
+		}
+	}
+}
+
+// pollService redeploys the service if the digest of its configured
+// tag in the registry differs from the digest of its running image.
+// A digest that has already been deployed once is not retried.
+func (d *Deployer) pollService(ctx context.Context, service config.Service) {
+	if !service.Poll() || d.index().policies[service.Name] != nil {
+		// Tag policies follow pushes, not a single tag
+		return
+	}
+
+	repo, tag, digest := parseImage(service.Image)
+	if digest != "" {
+		// Pinned images never change
+		return
+	}
+
+	logger := d.logger.WithFields(logrus.Fields{
+		"name":  service.Name,
+		"image": service.Image,
+	})
+
+	remote, err := d.registry.Digest(ctx, repo, tag)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to poll registry")
+		return
+	}
+
+	id := d.findContainer(ctx, containerName(service), logger)
+	if id == "" {
+		logger.Debug("Service has no container, skipping")
+		return
+	}
+
+	c := d.inspectContainer(ctx, id, logger)
+	if c == nil {
+		return
+	}
+	img, err := d.client.InspectImage(c.Image)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to inspect image of container")
+		return
+	}
+	for _, repoDigest := range img.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+remote) {
+			logger.Debug("Service is up to date")
+			return
+		}
+	}
+
+	d.mu.Lock()
+	prev, polled := d.polled[service.Name]
+	d.polled[service.Name] = remote
+	d.mu.Unlock()
+	if prev == remote {
+		logger.WithField("digest", remote).Debug("Digest already deployed once, skipping")
+		return
+	}
+	if prev == "" && (polled || c.Config != nil && c.Config.Labels[PinnedLabel] == "true") {
+		// Only new digests end rollbacks
+		logger.WithField("digest", remote).Debug("Service was rolled back, skipping")
+		return
+	}
+
+	logger.WithField("digest", remote).Info("Found new image in registry")
+	_, err = d.Redeploy(service.Name, nil)
+	if err != nil {
+		logger.WithError(err).Error("Failed to queue job")
+	}
+}
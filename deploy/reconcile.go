@@ -0,0 +1,99 @@
+package deploy
+
+import (
+	"context"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+)
+
+// ReconcileMode configures which services are
+// redeployed when the Deployer reconciles them.
+type ReconcileMode string
+
+const (
+	// ReconcileOff leaves all services alone.
+	ReconcileOff ReconcileMode = "off"
+	// ReconcileMissing deploys services without a container.
+	ReconcileMissing ReconcileMode = "missing"
+	// ReconcileDrift also redeploys services whose container
+	// differs from the configuration of the service.
+	ReconcileDrift ReconcileMode = "drift"
+)
+
+// ParseReconcileMode parses a ReconcileMode.
+func ParseReconcileMode(s string) (ReconcileMode, error) {
+	switch m := ReconcileMode(s); m {
+	case ReconcileOff, ReconcileMissing, ReconcileDrift:
+		return m, nil
+	}
+	return "", errors.Errorf("unknown reconcile mode %q, expected off, missing or drift", s)
+}
+
+// Reconcile queues a redeploy of every service that has no
+// container, and with ReconcileDrift, of every service whose
+// container was created with other settings than the service
+// is configured with. Redeploys pull the image of the service,
+// and create and start its container. The queued jobs are returned.
+func (d *Deployer) Reconcile(ctx context.Context, mode ReconcileMode) ([]Job, error) {
+	if mode == ReconcileOff {
+		return nil, nil
+	}
+
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Context: ctx,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	idx := d.index()
+	var jobs []Job
+	for _, name := range idx.names {
+		logger := d.logger.WithField("name", name)
+
+		service := idx.services[name]
+		ids := replicaContainers(service, containers)
+		var missing int
+		for _, n := range service.ContainerNames() {
+			if _, ok := ids[n]; !ok {
+				missing++
+			}
+		}
+
+		switch {
+		case len(ids) == 0 && missing > 0:
+			logger.Info("Service has no container, deploying")
+		case missing > 0:
+			logger.WithField("missing", missing).Info("Service is missing replicas, deploying")
+		case mode == ReconcileDrift:
+			drift := surplusDrift(service, ids)
+			for i, n := range service.ContainerNames() {
+				c, err := d.client.InspectContainerWithContext(ids[n], ctx)
+				if err != nil {
+					return jobs, errors.Wrapf(err, "failed to inspect container %s of %s", n, name)
+				}
+				drift = append(drift, d.containerDrift(service, i+1, c)...)
+			}
+			if len(drift) == 0 {
+				logger.Debug("Service is up to date")
+				continue
+			}
+			for _, dr := range drift {
+				logger.WithFields(dr.fields()).Info("Container differs from configuration")
+			}
+			logger.Info("Service has drifted, redeploying")
+		default:
+			continue
+		}
+
+		job, err := d.redeploy(name, true, nil)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
@@ -0,0 +1,149 @@
+package deploy
+
+import (
+	"reflect"
+
+	"github.com/docker/cli/cli/compose/types"
+
+	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/policy"
+)
+
+// serviceIndex indexes the configured services. It is
+// replaced as a whole when the configuration is reloaded.
+type serviceIndex struct {
+	services       map[string]config.Service
+	names          []string
+	imageToService map[string][]config.Service
+	// repoToPolicy maps repositories to the services
+	// following tags of the repository by tag policy.
+	repoToPolicy map[string][]config.Service
+	policies     map[string]policy.Policy
+	// networks are the top-level networks of the configuration.
+	networks map[string]types.NetworkConfig
+	// volumes are the top-level volumes of the configuration.
+	volumes map[string]types.VolumeConfig
+	// secrets and configs are the top-level secrets
+	// and configs of the configuration.
+	secrets map[string]types.SecretConfig
+	configs map[string]types.ConfigObjConfig
+	// rank is the position of each service in dependency order.
+	rank map[string]int
+	// dependents lists the services depending on each service.
+	dependents map[string][]string
+}
+
+// newServiceIndex indexes the services of the configuration,
+// checking that containers can be created for all of them.
+func newServiceIndex(conf *config.Config) (*serviceIndex, error) {
+	idx := &serviceIndex{
+		services:       map[string]config.Service{},
+		imageToService: map[string][]config.Service{},
+		repoToPolicy:   map[string][]config.Service{},
+		policies:       map[string]policy.Policy{},
+		networks:       conf.Networks,
+		volumes:        conf.Volumes,
+		secrets:        conf.Secrets,
+		configs:        conf.Configs,
+		rank:           map[string]int{},
+		dependents:     map[string][]string{},
+	}
+
+	services, err := config.DependencyOrder(conf.Services)
+	if err != nil {
+		return nil, err
+	}
+	for i, service := range services {
+		idx.rank[service.Name] = i
+		for _, dep := range service.DependsOn {
+			idx.dependents[dep] = append(idx.dependents[dep], service.Name)
+		}
+		idx.services[service.Name] = service
+		idx.names = append(idx.names, service.Name)
+
+		// Check now so we don't have to check later
+		_, err := service.CreateContainerOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := service.TagPolicy()
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			idx.imageToService[service.Image] = append(idx.imageToService[service.Image], service)
+			continue
+		}
+		idx.policies[service.Name] = p
+		repo, _, _ := parseImage(service.Image)
+		idx.repoToPolicy[repo] = append(idx.repoToPolicy[repo], service)
+	}
+
+	return idx, nil
+}
+
+// index returns the index of the current configuration.
+func (d *Deployer) index() *serviceIndex {
+	return d.conf.Load().(*serviceIndex)
+}
+
+// Changes summarizes the services that were added,
+// removed or changed when the configuration was reloaded.
+type Changes struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// Empty returns true if no service was added, removed or changed.
+func (c Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+// Reload replaces the configuration of the services. The new
+// configuration is checked in full before it is swapped in, and
+// if it is invalid, an error is returned and the current
+// configuration is kept. Jobs that are already queued deploy
+// their services as they were configured when queued.
+// Containers are left alone, even if the number of replicas
+// of a service changed; use Redeploy to recreate the containers
+// of changed services and to scale them.
+func (d *Deployer) Reload(conf *config.Config) (Changes, error) {
+	idx, err := newServiceIndex(conf)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev := d.index()
+	d.conf.Store(idx)
+
+	var changes Changes
+	for _, name := range idx.names {
+		old, ok := prev.services[name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, name)
+		case !reflect.DeepEqual(old, idx.services[name]):
+			changes.Changed = append(changes.Changed, name)
+			delete(d.polled, name)
+		}
+	}
+	for _, name := range prev.names {
+		if _, ok := idx.services[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+			delete(d.drift, name)
+			delete(d.polled, name)
+		}
+	}
+	// Drift is relative to the configuration
+	for _, names := range [][]string{changes.Added, changes.Changed} {
+		for _, name := range names {
+			d.recheck(name)
+		}
+	}
+
+	return changes, nil
+}
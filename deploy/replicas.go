@@ -0,0 +1,224 @@
+package deploy
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// containerName returns the name of the first container of the
+// service, whose image is taken to be the image the service runs.
+func containerName(service config.Service) string {
+	if names := service.ContainerNames(); len(names) > 0 {
+		return names[0]
+	}
+	return service.Name
+}
+
+// ownsContainer returns whether the container with the name and
+// labels belongs to the service. Containers with the names of the
+// service and its replicas always do, but other containers named
+// like its replicas only if they were created for the service, so
+// that containers of other services are never taken for surplus
+// replicas.
+func ownsContainer(service config.Service, name string, labels map[string]string) bool {
+	if name == service.Name || sliceContains(service.ContainerNames(), name) {
+		return true
+	}
+	_, ok := service.ReplicaIndex(name)
+	return ok && labels[ServiceLabel] == service.Name
+}
+
+// replicaContainers returns the IDs of the listed
+// containers that belong to the service, by name.
+func replicaContainers(service config.Service, containers []docker.APIContainers) map[string]string {
+	ids := map[string]string{}
+	for _, container := range containers {
+		for _, name := range container.Names {
+			name = strings.TrimPrefix(name, "/")
+			if ownsContainer(service, name, container.Labels) {
+				ids[name] = container.ID
+			}
+		}
+	}
+	return ids
+}
+
+// serviceContainers returns the IDs of the containers of the
+// service by name, or nil if the containers could not be listed.
+func (d *Deployer) serviceContainers(ctx context.Context, service config.Service, logger *logrus.Entry) map[string]string {
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Context: ctx,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to list containers")
+		// Soldier on anyway
+		return nil
+	}
+	return replicaContainers(service, containers)
+}
+
+// scaleDown stops and removes the containers of the service
+// that aren't among its replicas, such as when the number of
+// replicas was reduced.
+func (d *Deployer) scaleDown(ctx context.Context, service config.Service, logger *logrus.Entry) {
+	ids := d.serviceContainers(ctx, service, logger)
+	names := service.ContainerNames()
+	var surplus []string
+	for name := range ids {
+		if !sliceContains(names, name) {
+			surplus = append(surplus, name)
+		}
+	}
+	sort.Strings(surplus)
+
+	for _, name := range surplus {
+		logger.WithField("container", name).Info("Removing surplus replica")
+		d.stopContainer(ctx, ids[name], logger)
+		d.removeContainer(ctx, ids[name], logger)
+	}
+}
+
+// surplusDrift returns the drift of the number of containers of the
+// service, if it has containers that aren't among its replicas.
+func surplusDrift(service config.Service, ids map[string]string) []Drift {
+	names := service.ContainerNames()
+	for name := range ids {
+		if !sliceContains(names, name) {
+			return []Drift{{
+				Field: "replicas",
+				Want:  strconv.Itoa(len(names)),
+				Have:  strconv.Itoa(len(ids)),
+			}}
+		}
+	}
+	return nil
+}
+
+// replicaUpdate is the outcome of replacing a replica.
+type replicaUpdate struct {
+	replica int
+	prev    previous
+	err     error
+}
+
+// updateReplicas replaces the replicas of the service in batches of
+// its update parallelism, waiting for its update delay between
+// batches. When a replica fails to update, the failure action of
+// the service decides whether the remaining replicas are updated,
+// and whether the updated replicas are rolled back.
+func (d *Deployer) updateReplicas(ctx context.Context, job *Job, service config.Service, logger *logrus.Entry) error {
+	names := service.ContainerNames()
+	batch := service.Parallelism()
+	if batch == 0 || batch > len(names) {
+		batch = len(names)
+	}
+
+	var updated []replicaUpdate
+	var failed error
+	for start := 0; start < len(names); start += batch {
+		if start > 0 && service.UpdateDelay() > 0 {
+			select {
+			case <-time.After(service.UpdateDelay()):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		end := start + batch
+		if end > len(names) {
+			end = len(names)
+		}
+		results := make([]replicaUpdate, end-start)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				prev, err := d.replaceReplica(ctx, job, service, i+1, replicaLogger(service, names[i], logger))
+				results[i-start] = replicaUpdate{replica: i + 1, prev: prev, err: err}
+			}(i)
+		}
+		wg.Wait()
+
+		var err error
+		for _, result := range results {
+			if result.err == nil {
+				updated = append(updated, result)
+				continue
+			}
+			if service.Deploy.Replicas != nil {
+				result.err = errors.Wrapf(result.err, "replica %s", names[result.replica-1])
+			}
+			if err == nil {
+				err = result.err
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		switch service.FailureAction() {
+		case config.FailureContinue:
+			logger.WithError(err).Warn("Replica failed to update, continuing")
+			if failed == nil {
+				failed = err
+			}
+		case config.FailureRollback:
+			logger.WithError(err).Warn("Replica failed to update, rolling back updated replicas")
+			for _, u := range updated {
+				d.rollbackReplica(ctx, job, service, u, replicaLogger(service, names[u.replica-1], logger))
+			}
+			return err
+		default:
+			if end < len(names) {
+				logger.WithError(err).Warn("Replica failed to update, pausing update")
+			}
+			return err
+		}
+	}
+
+	return failed
+}
+
+// rollbackReplica recreates the updated replica from the
+// image it used before it was updated, if it had one.
+func (d *Deployer) rollbackReplica(ctx context.Context, job *Job, service config.Service, u replicaUpdate, logger *logrus.Entry) {
+	if u.prev.image == "" {
+		logger.Debug("Replica had no previous container, not rolling back")
+		return
+	}
+
+	cOpts := d.containerOptions(job, service, u.replica)
+	if id := d.findContainer(ctx, cOpts.Name, logger); id != "" {
+		d.stopContainer(ctx, id, logger)
+		d.removeContainer(ctx, id, logger)
+	}
+	_ = d.rollback(ctx, job, service, cOpts, u.prev, logger)
+}
+
+// replicaName returns the name of the container for
+// services with replicas, and otherwise an empty string.
+func replicaName(service config.Service, name string) string {
+	if service.Deploy.Replicas == nil {
+		return ""
+	}
+	return name
+}
+
+func replicaLogger(service config.Service, name string, logger *logrus.Entry) *logrus.Entry {
+	if service.Deploy.Replicas == nil {
+		return logger
+	}
+	return logger.WithField("container", name)
+}
@@ -0,0 +1,217 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/docker/cli/cli/compose/types"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// secretsDir is where secrets and configs are mounted
+// in containers unless they configure an absolute target.
+const secretsDir = "/run/secrets"
+
+// DefaultSecretsDir is the directory secrets and
+// configs are written to on the host by default.
+const DefaultSecretsDir = "/var/lib/redeploy/secrets"
+
+// WithSecretsDir configures the directory secrets and configs
+// are written to before they are bind-mounted into containers.
+// The path is resolved by Docker, so if redeploy runs in a
+// container, the directory has to be mounted at the same path.
+// Defaults to DefaultSecretsDir.
+func WithSecretsDir(dir string) DeployerOption {
+	return func(d *Deployer) {
+		d.secretsDir = dir
+	}
+}
+
+// file is a secret or config of a service. Its content
+// must never be logged or returned to clients.
+type file struct {
+	kind    string
+	name    string
+	target  string
+	uid     int
+	gid     int
+	mode    int64
+	content []byte
+}
+
+// readFiles reads the secrets and configs of the service from
+// their sources. They are read on every deploy, so that changes
+// to the sources are picked up by the next deploy.
+func (d *Deployer) readFiles(service config.Service) ([]file, error) {
+	idx := d.index()
+	var files []file
+	for _, secret := range service.Secrets {
+		f, err := readFile("secret", types.FileObjectConfig(idx.secrets[secret.Source]), types.FileReferenceConfig(secret))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	for _, conf := range service.Configs {
+		f, err := readFile("config", types.FileObjectConfig(idx.configs[conf.Source]), types.FileReferenceConfig(conf))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// fileTarget returns the path of the file in the container.
+func fileTarget(ref types.FileReferenceConfig) string {
+	switch {
+	case ref.Target == "":
+		return path.Join(secretsDir, ref.Source)
+	case !path.IsAbs(ref.Target):
+		return path.Join(secretsDir, ref.Target)
+	}
+	return ref.Target
+}
+
+func readFile(kind string, obj types.FileObjectConfig, ref types.FileReferenceConfig) (file, error) {
+	f := file{
+		kind:   kind,
+		name:   ref.Source,
+		target: fileTarget(ref),
+		// Owned by the user running redeploy by default
+		uid: -1,
+		gid: -1,
+		// Read-only by default
+		mode: 0444,
+	}
+	// Checked on startup
+	if ref.UID != "" {
+		f.uid, _ = strconv.Atoi(ref.UID)
+	}
+	if ref.GID != "" {
+		f.gid, _ = strconv.Atoi(ref.GID)
+	}
+	if ref.Mode != nil {
+		f.mode = int64(*ref.Mode)
+	}
+
+	if env, ok := obj.Labels[config.EnvLabel]; ok && obj.External.External {
+		content, ok := os.LookupEnv(env)
+		if !ok {
+			return file{}, errors.Errorf("environment variable %s of %s %s is not set", env, kind, f.name)
+		}
+		f.content = []byte(content)
+		return f, nil
+	}
+
+	content, err := ioutil.ReadFile(obj.File)
+	if err != nil {
+		// The error only contains the path of the file
+		return file{}, errors.Wrapf(err, "failed to read %s %s", kind, f.name)
+	}
+	f.content = content
+	return f, nil
+}
+
+// writeFiles writes the files of the service to the secrets
+// directory. Files of earlier deploys are replaced rather than
+// overwritten, so running containers keep the files they
+// were started with until they are replaced.
+func (d *Deployer) writeFiles(service config.Service, files []file, logger *logrus.Entry) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(d.secretsDir, service.Name)
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		// Only the user running redeploy may read the files on the host
+		err = os.Chmod(dir, 0700)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create secrets directory")
+	}
+
+	for _, f := range files {
+		name := d.filePath(service, f.target)
+		err := writeFile(name, f)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write %s %s", f.kind, f.name)
+		}
+		logger.WithFields(logrus.Fields{
+			f.kind:   f.name,
+			"target": f.target,
+		}).Debug("Wrote file")
+	}
+	return nil
+}
+
+func writeFile(name string, f file) error {
+	err := os.MkdirAll(filepath.Dir(name), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(f.content)
+	if err == nil {
+		err = tmp.Chmod(os.FileMode(f.mode))
+	}
+	if err == nil {
+		err = tmp.Chown(f.uid, f.gid)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// filePath returns the path in the secrets directory of
+// the file of the service with the target.
+func (d *Deployer) filePath(service config.Service, target string) string {
+	return filepath.Join(d.secretsDir, service.Name, filepath.FromSlash(target))
+}
+
+// fileOptions adds read-only bind mounts of the
+// secrets and configs of the service to the options.
+func (d *Deployer) fileOptions(service config.Service, cOpts *docker.CreateContainerOptions) {
+	var targets []string
+	for _, secret := range service.Secrets {
+		targets = append(targets, fileTarget(types.FileReferenceConfig(secret)))
+	}
+	for _, conf := range service.Configs {
+		targets = append(targets, fileTarget(types.FileReferenceConfig(conf)))
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	if cOpts.HostConfig == nil {
+		cOpts.HostConfig = &docker.HostConfig{}
+	}
+	// Don't modify the mounts of the service
+	mounts := append([]docker.HostMount(nil), cOpts.HostConfig.Mounts...)
+	for _, target := range targets {
+		mounts = append(mounts, docker.HostMount{
+			Type:     "bind",
+			Source:   d.filePath(service, target),
+			Target:   target,
+			ReadOnly: true,
+		})
+	}
+	cOpts.HostConfig.Mounts = mounts
+}
@@ -0,0 +1,209 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// ErrUnknownService is returned when a service
+// is not present in the configuration.
+var ErrUnknownService = errors.New("unknown service")
+
+// ServiceStatus describes the current state of a configured service.
+type ServiceStatus struct {
+	Name        string   `json:"name"`
+	Image       string   `json:"image"`
+	ContainerID string   `json:"container_id,omitempty"`
+	ImageID     string   `json:"image_id,omitempty"`
+	Digests     []string `json:"digests,omitempty"`
+	// State is the state of the container, or "missing"
+	// if the service has no container.
+	State      string     `json:"state"`
+	LastDeploy *time.Time `json:"last_deploy,omitempty"`
+	// Drift lists the settings of the container that differ from
+	// the configuration, if drift detection is enabled.
+	Drift []Drift `json:"drift,omitempty"`
+	// Replicas is the number of running out of the configured
+	// replicas, e.g. "2/3", for services with replicas. The
+	// container is the first replica.
+	Replicas string `json:"replicas,omitempty"`
+}
+
+// Redeploy queues a job pulling the configured image
+// of the service and recreating its container. Services
+// with a tag policy are redeployed from the tag they run.
+// Services that were rolled back are redeployed from
+// the configured image, ending the rollback.
+func (d *Deployer) Redeploy(name string, callback func(Job)) (Job, error) {
+	return d.redeploy(name, false, callback)
+}
+
+// redeploy is like Redeploy, but if keepPinned is set, services
+// that were rolled back are redeployed from the image they were
+// rolled back to, so that repairs don't undo rollbacks.
+func (d *Deployer) redeploy(name string, keepPinned bool, callback func(Job)) (Job, error) {
+	idx := d.index()
+	service, ok := idx.services[name]
+	if !ok {
+		return Job{}, ErrUnknownService
+	}
+
+	image := service.Image
+	var pinned bool
+	if keepPinned {
+		if p := d.pinnedImage(d.ctx, containerName(service), d.logger.WithField("name", name)); p != "" {
+			image, pinned = p, true
+		}
+	}
+	if idx.policies[name] != nil && !pinned {
+		running := d.runningImage(d.ctx, containerName(service), d.logger.WithField("name", name))
+		configured, _, _ := parseImage(service.Image)
+		if repo, _, _ := parseImage(running); running != "" && repo == configured {
+			image = running
+		}
+	}
+
+	repo, tag, digest := parseImage(image)
+	push := Push{
+		Repository: repo,
+		Tag:        tag,
+		Digest:     digest,
+	}
+
+	job := newJob(push, []config.Service{service}, callback)
+	if image != service.Image {
+		job.image = image
+	}
+	job.pinned = pinned
+
+	return d.enqueue(job), nil
+}
+
+// Rollback queues a job recreating the container of the service
+// from another image of the configured repository. The image
+// is identified either by tag, by digest or by image ID.
+func (d *Deployer) Rollback(name, to string, callback func(Job)) (Job, error) {
+	service, ok := d.index().services[name]
+	if !ok {
+		return Job{}, ErrUnknownService
+	}
+
+	repo, _, _ := parseImage(service.Image)
+	push := Push{
+		Repository: repo,
+	}
+	if strings.HasPrefix(to, "sha256:") {
+		push.Digest = to
+	} else {
+		push.Tag = to
+	}
+
+	job := newJob(push, []config.Service{service}, callback)
+	job.image = push.Image()
+	job.pinned = true
+
+	d.mu.Lock()
+	// Polling keeps the rollback until the tag changes
+	d.polled[name] = ""
+	d.mu.Unlock()
+
+	return d.enqueue(job), nil
+}
+
+// Services returns the status of all configured services.
+func (d *Deployer) Services(ctx context.Context) ([]ServiceStatus, error) {
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Context: ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	idx := d.index()
+	var statuses []ServiceStatus
+	for _, name := range idx.names {
+		service := idx.services[name]
+		status := ServiceStatus{
+			Name:  name,
+			Image: service.Image,
+			State: "missing",
+		}
+
+		d.mu.Lock()
+		if t, ok := d.deployed[name]; ok {
+			status.LastDeploy = &t
+		}
+		status.Drift = append([]Drift(nil), d.drift[name]...)
+		d.mu.Unlock()
+
+		names := service.ContainerNames()
+		if service.Deploy.Replicas != nil {
+			var running int
+			for _, container := range containers {
+				for _, n := range names {
+					if sliceContains(container.Names, "/"+n) && container.State == "running" {
+						running++
+					}
+				}
+			}
+			status.Replicas = fmt.Sprintf("%d/%d", running, len(names))
+		}
+
+		for _, container := range containers {
+			if !sliceContains(container.Names, "/"+containerName(service)) {
+				continue
+			}
+			c, err := d.client.InspectContainerWithContext(container.ID, ctx)
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				// Removed since listing, e.g. by a deploy
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			status.ContainerID = container.ID
+			status.State = container.State
+			status.ImageID = c.Image
+
+			img, err := d.client.InspectImage(c.Image)
+			if err != nil && err != docker.ErrNoSuchImage {
+				return nil, err
+			}
+			if img != nil {
+				status.Digests = img.RepoDigests
+			}
+			break
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// parseImage splits an image reference into its
+// repository, tag and digest. If neither tag nor
+// digest is present, the tag defaults to latest.
+func parseImage(image string) (repo, tag, digest string) {
+	repo = image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, digest = repo[:i], repo[i+1:]
+	}
+	// A colon after the last slash separates the tag,
+	// any other colon separates the registry port.
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	if tag == "" && digest == "" {
+		tag = "latest"
+	}
+	return repo, tag, digest
+}
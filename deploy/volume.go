@@ -0,0 +1,113 @@
+package deploy
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/types"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// volumeName returns the name of the Docker volume of a
+// volume of the configuration, which defaults to its key.
+func volumeName(key string, v types.VolumeConfig) string {
+	switch {
+	case v.Name != "":
+		return v.Name
+	case v.External.External && v.External.Name != "":
+		return v.External.Name
+	}
+	return key
+}
+
+// volumeName returns the name of the Docker volume of the volume
+// of the configuration with the provided key. Host paths and
+// volumes that aren't configured keep their name.
+func (idx *serviceIndex) volumeName(key string) string {
+	v, ok := idx.volumes[key]
+	if !ok {
+		return key
+	}
+	return volumeName(key, v)
+}
+
+// volumeOptions renames the named volumes mounted by the options
+// from their keys in the configuration to their Docker volumes.
+func (idx *serviceIndex) volumeOptions(cOpts *docker.CreateContainerOptions) {
+	if cOpts.HostConfig == nil {
+		return
+	}
+	mounts := make([]docker.HostMount, 0, len(cOpts.HostConfig.Mounts))
+	for _, m := range cOpts.HostConfig.Mounts {
+		if m.Type == "volume" {
+			m.Source = idx.volumeName(m.Source)
+		}
+		mounts = append(mounts, m)
+	}
+	binds := make([]string, 0, len(cOpts.HostConfig.Binds))
+	for _, bind := range cOpts.HostConfig.Binds {
+		parts := strings.SplitN(bind, ":", 2)
+		binds = append(binds, idx.volumeName(parts[0])+":"+parts[1])
+	}
+	if len(mounts) > 0 {
+		cOpts.HostConfig.Mounts = mounts
+	}
+	if len(binds) > 0 {
+		cOpts.HostConfig.Binds = binds
+	}
+}
+
+// ensureVolumes creates the named volumes of the service that
+// don't exist yet. External volumes are never created, and an
+// error is returned if one of them doesn't exist.
+func (d *Deployer) ensureVolumes(ctx context.Context, service config.Service, logger *logrus.Entry) error {
+	d.volumeMu.Lock()
+	defer d.volumeMu.Unlock()
+
+	idx := d.index()
+	var keys []string
+	for _, vol := range service.Volumes {
+		if vol.Type != "volume" {
+			continue
+		}
+		if _, ok := idx.volumes[vol.Source]; ok {
+			keys = append(keys, vol.Source)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := idx.volumes[key]
+		name := volumeName(key, v)
+
+		_, err := d.client.InspectVolume(name)
+		if err == nil {
+			continue
+		}
+		if err != docker.ErrNoSuchVolume {
+			return errors.Wrapf(err, "failed to inspect volume %s", name)
+		}
+		if v.External.External {
+			return errors.Errorf("external volume %s does not exist", name)
+		}
+
+		_, err = d.client.CreateVolume(docker.CreateVolumeOptions{
+			Name:       name,
+			Driver:     v.Driver,
+			DriverOpts: v.DriverOpts,
+			Labels:     v.Labels,
+			Context:    ctx,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create volume %s", name)
+		}
+		logger.WithField("volume", name).Info("Created volume")
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package deploy
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// WithDriftDetection configures the Deployer to watch the containers
+// of the services for drift from their configuration. A service is
+// checked whenever Docker reports a change to one of its containers,
+// and all services are checked every interval. What is done about
+// drift is configured per service with the redeploy.drift label.
+func WithDriftDetection(interval time.Duration) DeployerOption {
+	return func(d *Deployer) {
+		d.driftInterval = interval
+	}
+}
+
+// Drift returns the drift last found for each service
+// that has drifted from its configuration.
+func (d *Deployer) Drift() map[string][]Drift {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	drift := make(map[string][]Drift, len(d.drift))
+	for name, dr := range d.drift {
+		drift[name] = append([]Drift(nil), dr...)
+	}
+	return drift
+}
+
+// watch checks the services for drift on container
+// events and every interval, until the Deployer is closed.
+func (d *Deployer) watch() {
+	defer d.wg.Done()
+
+	events := d.subscribe()
+	defer func() {
+		if events != nil {
+			_ = d.client.RemoveEventListener(events)
+		}
+	}()
+
+	ticker := time.NewTicker(d.driftInterval)
+	defer ticker.Stop()
+
+	d.checkAll()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// The client stops listening when the
+				// stream ends, so subscribe again.
+				events = d.subscribe()
+				d.checkAll()
+				continue
+			}
+			if service, ok := d.eventService(event); ok {
+				d.checkDrift(d.ctx, service)
+			}
+		case name := <-d.checks:
+			if service, ok := d.index().services[name]; ok {
+				d.checkDrift(d.ctx, service)
+			}
+		case <-ticker.C:
+			d.checkAll()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// recheck queues a drift check of the service, as events
+// are ignored while it is deployed. If the queue is full,
+// the service is checked with all others.
+func (d *Deployer) recheck(name string) {
+	if d.checks == nil {
+		return
+	}
+	select {
+	case d.checks <- name:
+	default:
+	}
+}
+
+// subscribe subscribes to Docker events. If subscribing
+// fails, nil is returned and services are only checked
+// every interval.
+func (d *Deployer) subscribe() chan *docker.APIEvents {
+	events := make(chan *docker.APIEvents, 100)
+	err := d.client.AddEventListener(events)
+	if err != nil {
+		d.logger.WithError(err).Warn("Failed to subscribe to Docker events")
+		return nil
+	}
+	return events
+}
+
+// eventService returns the service the container of
+// the event belongs to, or false if there is none.
+func (d *Deployer) eventService(event *docker.APIEvents) (config.Service, bool) {
+	if event.Type != "container" {
+		return config.Service{}, false
+	}
+	idx := d.index()
+	for _, attr := range []string{"name", "oldName"} {
+		name := strings.TrimPrefix(event.Actor.Attributes[attr], "/")
+		for _, service := range idx.services {
+			// Container events carry the labels of the container
+			if ownsContainer(service, name, event.Actor.Attributes) {
+				return service, true
+			}
+		}
+	}
+	return config.Service{}, false
+}
+
+func (d *Deployer) checkAll() {
+	idx := d.index()
+	for _, name := range idx.names {
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+		d.checkDrift(d.ctx, idx.services[name])
+	}
+}
+
+// checkDrift compares the container of the service to its
+// configuration, and reports or repairs any drift according
+// to the drift policy of the service. Services are not checked
+// while they are being deployed. Drift is logged and repaired
+// once when found, and not again until it changes.
+func (d *Deployer) checkDrift(ctx context.Context, service config.Service) {
+	policy := service.DriftPolicy()
+	if policy == config.DriftIgnore {
+		return
+	}
+
+	logger := d.logger.WithField("name", service.Name)
+	if d.deploying(service.Name) {
+		logger.Debug("Service is being deployed, skipping drift check")
+		return
+	}
+
+	drift, ok := d.serviceDrift(ctx, service, logger)
+	if !ok || d.deploying(service.Name) {
+		// The container may have changed during the check
+		return
+	}
+
+	d.mu.Lock()
+	prev := d.drift[service.Name]
+	if len(drift) > 0 {
+		d.drift[service.Name] = drift
+	} else {
+		delete(d.drift, service.Name)
+	}
+	d.mu.Unlock()
+
+	if reflect.DeepEqual(prev, drift) {
+		return
+	}
+	if len(drift) == 0 {
+		logger.Info("Service no longer drifts from configuration")
+		return
+	}
+	for _, dr := range drift {
+		logger.WithFields(dr.fields()).Warn("Container drifted from configuration")
+	}
+
+	if policy != config.DriftRepair {
+		return
+	}
+	job, err := d.redeploy(service.Name, true, nil)
+	if err != nil {
+		logger.WithError(err).Error("Failed to queue repair")
+		return
+	}
+	logger.WithField("job", job.ID).Info("Repairing drifted service")
+}
+
+// serviceDrift returns the drift of the containers of the service,
+// including whether they are missing or not running, and whether
+// there are surplus replicas. If a container could not be inspected,
+// false is returned.
+func (d *Deployer) serviceDrift(ctx context.Context, service config.Service, logger *logrus.Entry) ([]Drift, bool) {
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Context: ctx,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list containers")
+		return nil, false
+	}
+	ids := replicaContainers(service, containers)
+
+	var drift []Drift
+	for i, name := range service.ContainerNames() {
+		missing := Drift{Container: replicaName(service, name), Field: "container", Want: "running", Have: "missing"}
+		id, ok := ids[name]
+		if !ok {
+			drift = append(drift, missing)
+			continue
+		}
+
+		c, err := d.client.InspectContainerWithContext(id, ctx)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			drift = append(drift, missing)
+			continue
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Failed to inspect container")
+			return nil, false
+		}
+
+		if !c.State.Running {
+			drift = append(drift, Drift{Container: missing.Container, Field: "container", Want: "running", Have: c.State.Status})
+		}
+		drift = append(drift, d.containerDrift(service, i+1, c)...)
+	}
+	return append(drift, surplusDrift(service, ids)...), true
+}
+
+// deploying returns whether a job for the service has not yet finished.
+func (d *Deployer) deploying(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job := d.latest[name]
+	return job != nil && !job.State.Done()
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// ServicesPath is the path the API handler should be served on.
+// Both ServicesPath and ServicesPath + "/" should be routed to it.
+const ServicesPath = "/services"
+
+// API is a management API for the configured services. It serves
+//
+//	GET  /services                            lists the services and their containers
+//	POST /services/{name}/redeploy            pulls and recreates the service
+//	POST /services/{name}/rollback?to={image} recreates the service from a tag,
+//	                                          digest or image ID of its repository
+//
+// Deploys are queued with the same Deployer as webhook requests,
+// and are answered with the queued job.
+type API struct {
+	logger   *logrus.Logger
+	deployer *deploy.Deployer
+	auth     []Authenticator
+}
+
+// NewAPI creates a new API handler for the services of the
+// provided Deployer. If logger is nil, nothing is logged.
+func NewAPI(d *deploy.Deployer, logger *logrus.Logger, auth ...Authenticator) *API {
+	if logger == nil {
+		logger = logrus.New()
+		logger.Out = ioutil.Discard
+	}
+	return &API{
+		logger:   logger,
+		deployer: d,
+		auth:     auth,
+	}
+}
+
+func (a API) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	_, ok := authenticate(a.logger, a.auth, resp, req)
+	if !ok {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, ServicesPath), "/")
+	if path == "" {
+		if req.Method != http.MethodGet {
+			http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.listServices(resp, req)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.Error(resp, "not found", http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := parts[0]
+	logger := a.logger.WithField("name", name)
+
+	var job deploy.Job
+	var err error
+	switch parts[1] {
+	case "redeploy":
+		logger.Info("Redeploy requested")
+		job, err = a.deployer.Redeploy(name, nil)
+	case "rollback":
+		to := req.URL.Query().Get("to")
+		if to == "" {
+			http.Error(resp, "missing to parameter", http.StatusBadRequest)
+			return
+		}
+		logger.WithField("to", to).Info("Rollback requested")
+		job, err = a.deployer.Rollback(name, to, nil)
+	default:
+		http.Error(resp, "not found", http.StatusNotFound)
+		return
+	}
+	if err == deploy.ErrUnknownService {
+		http.Error(resp, "service not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to queue job")
+		http.Error(resp, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeAccepted(a.logger, resp, job)
+}
+
+func (a API) listServices(resp http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 30*time.Second)
+	defer cancel()
+
+	services, err := a.deployer.Services(ctx)
+	if err != nil {
+		a.logger.WithError(err).Error("Failed to list services")
+		http.Error(resp, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(a.logger, resp, http.StatusOK, services)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Authenticator verifies that an incoming webhook request
+// was sent by a trusted party. The body is passed separately
+// since the request body has already been consumed.
+type Authenticator interface {
+	Authenticate(req *http.Request, body []byte) error
+}
+
+// AuthError is returned by an Authenticator when it
+// rejects a request. Code is the HTTP status code
+// the request should be answered with.
+type AuthError struct {
+	Code   int
+	Reason string
+}
+
+func (a AuthError) Error() string {
+	return a.Reason
+}
+
+func unauthorized(format string, args ...interface{}) error {
+	return AuthError{
+		Code:   http.StatusUnauthorized,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func forbidden(format string, args ...interface{}) error {
+	return AuthError{
+		Code:   http.StatusForbidden,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// TokenAuthenticator requires a shared secret token to be present
+// in the request, either in a header or as a query parameter.
+// Docker Hub does not support custom headers, so for Docker Hub
+// webhooks the token has to be part of the configured webhook URL.
+type TokenAuthenticator struct {
+	// Token is the shared secret.
+	Token string
+	// Header is the name of the header to read the token from.
+	// If empty, the header is not consulted.
+	Header string
+	// Prefix is stripped from the header value before comparison,
+	// for example "Bearer ".
+	Prefix string
+	// Param is the name of the query parameter to read the token from.
+	// If empty, the query parameter is not consulted.
+	Param string
+}
+
+// Authenticate implements Authenticator.
+func (t TokenAuthenticator) Authenticate(req *http.Request, _ []byte) error {
+	var token string
+	if t.Header != "" {
+		token = strings.TrimPrefix(req.Header.Get(t.Header), t.Prefix)
+	}
+	if token == "" && t.Param != "" {
+		token = req.URL.Query().Get(t.Param)
+	}
+	if token == "" {
+		return unauthorized("missing token")
+	}
+	if !constantTimeEqual(token, t.Token) {
+		return unauthorized("invalid token")
+	}
+
+	return nil
+}
+
+// HMACAuthenticator requires the request body to be signed
+// with HMAC-SHA256 using a shared secret. The hex encoded
+// signature is read from Header, optionally prefixed with "sha256=".
+type HMACAuthenticator struct {
+	Secret []byte
+	Header string
+}
+
+// Authenticate implements Authenticator.
+func (h HMACAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	sig := strings.TrimPrefix(req.Header.Get(h.Header), "sha256=")
+	if sig == "" {
+		return unauthorized("missing signature header %q", h.Header)
+	}
+
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return unauthorized("malformed signature")
+	}
+
+	mac := hmac.New(sha256.New, h.Secret)
+	// Writes to a hash never fail
+	_, _ = mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return unauthorized("invalid signature")
+	}
+
+	return nil
+}
+
+// IPAllowlist only accepts requests from the configured networks.
+// The remote address of the connection is used; headers such
+// as X-Forwarded-For are not trusted.
+type IPAllowlist []*net.IPNet
+
+// ParseIPAllowlist parses a list of IP addresses and CIDR ranges.
+func ParseIPAllowlist(entries []string) (IPAllowlist, error) {
+	var list IPAllowlist
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range: %q", entry)
+		}
+		list = append(list, ipNet)
+	}
+
+	return list, nil
+}
+
+// Authenticate implements Authenticator.
+func (l IPAllowlist) Authenticate(req *http.Request, _ []byte) error {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return forbidden("unparseable remote address %q", req.RemoteAddr)
+	}
+	for _, ipNet := range l {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+
+	return forbidden("address %s not in allowlist", ip)
+}
+
+// constantTimeEqual compares the hashes of a and b so that
+// the comparison does not leak the length of the secret either.
+func constantTimeEqual(a, b string) bool {
+	ah := sha256.Sum256([]byte(a))
+	bh := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ah[:], bh[:]) == 1
+}
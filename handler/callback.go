@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// DockerHubCallbackHost is the host Docker Hub
+// webhook callback URLs are served from.
+const DockerHubCallbackHost = "registry.hub.docker.com"
+
+// callbackContext is the context reported in callbacks.
+const callbackContext = "redeploy"
+
+// maxDescription is the maximum length
+// of the description of a callback.
+const maxDescription = 255
+
+// Callback states defined by Docker Hub.
+const (
+	CallbackSuccess = "success"
+	CallbackFailure = "failure"
+	CallbackError   = "error"
+)
+
+// Callback is the structure of the JSON posted
+// to the callback URL of a Docker Hub webhook.
+// https://docs.docker.com/docker-hub/webhooks/#validate-a-webhook-callback
+type Callback struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+}
+
+// WithCallbackHosts configures the hosts callbacks may be sent
+// to, replacing the default of DockerHubCallbackHost. Hosts
+// may include a port, in which case only that port is allowed.
+func WithCallbackHosts(hosts ...string) DockerHookOption {
+	return func(d *DockerHook) {
+		d.callbackHosts = hosts
+	}
+}
+
+// WithCallbackRetries configures how many times a failed callback is
+// retried, and the delay before the first retry. The delay doubles
+// with each retry.
+func WithCallbackRetries(retries int, backoff time.Duration) DockerHookOption {
+	return func(d *DockerHook) {
+		d.callbackRetries = retries
+		d.callbackBackoff = backoff
+	}
+}
+
+// WithJobsURL configures the external URL of the jobs endpoint,
+// for example https://example.com/jobs/. Callbacks link
+// to the job they report on under this URL.
+func WithJobsURL(u string) DockerHookOption {
+	return func(d *DockerHook) {
+		d.jobsURL = u
+	}
+}
+
+// jobCallback returns the callback reporting the outcome of the job.
+func (h DockerHook) jobCallback(job deploy.Job) Callback {
+	c := Callback{
+		State:   CallbackSuccess,
+		Context: callbackContext,
+	}
+	if h.jobsURL != "" {
+		c.TargetURL = strings.TrimSuffix(h.jobsURL, "/") + "/" + job.ID
+	}
+
+	image := job.Push.Image()
+	if job.Digest != "" && job.Push.Digest == "" {
+		image += "@" + job.Digest
+	}
+
+	switch {
+	case job.State == deploy.StateFailed:
+		c.State = CallbackFailure
+		var errs []string
+		for _, e := range job.Errors {
+			if e.Service != "" {
+				errs = append(errs, e.Service+": "+e.Error)
+			} else {
+				errs = append(errs, e.Error)
+			}
+		}
+		c.Description = fmt.Sprintf("Failed to deploy %s", image)
+		if len(job.RolledBack) > 0 {
+			// Ahead of the errors, so it isn't cut off
+			c.Description += ", rolled back " + describe(job.RolledBack, " to ")
+		}
+		c.Description += ": " + strings.Join(errs, "; ")
+	case len(job.Services) > 0:
+		c.Description = fmt.Sprintf("Deployed %s to %s", image, strings.Join(job.Services, ", "))
+	default:
+		var reasons []string
+		if len(job.SupersededBy) > 0 || len(job.Ignored) == 0 {
+			reasons = append(reasons, "superseded by newer pushes")
+		}
+		if len(job.Ignored) > 0 {
+			reasons = append(reasons, "newer tags are deployed to "+describe(job.Ignored, " at "))
+		}
+		c.Description = fmt.Sprintf("Skipped %s, %s", image, strings.Join(reasons, "; "))
+	}
+
+	return c
+}
+
+// describe lists the services of the map in order, each
+// joined by sep to the value of the service in the map.
+func describe(m map[string]string, sep string) string {
+	services := make([]string, 0, len(m))
+	for service := range m {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for i, service := range services {
+		services[i] = service + sep + m[service]
+	}
+	return strings.Join(services, ", ")
+}
+
+// callback posts the callback to the callback URL in the background,
+// retrying failed attempts. URLs of hosts not in the allowlist are
+// never requested.
+func (h DockerHook) callback(callbackURL string, c Callback) {
+	logger := h.logger.WithField("state", c.State)
+	if callbackURL == "" {
+		logger.Debug("Request has no callback URL")
+		return
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err == nil {
+		err = h.checkCallbackURL(u)
+	}
+	if err != nil {
+		// The URL is under the control of the sender, so don't log it
+		logger.WithError(err).Warn("Refusing to send callback")
+		return
+	}
+
+	if len(c.Description) > maxDescription {
+		c.Description = c.Description[:maxDescription-3] + "..."
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode callback")
+		return
+	}
+
+	go func() {
+		backoff := h.callbackBackoff
+		for attempt := 0; ; attempt++ {
+			err := h.postCallback(u.String(), body)
+			if err == nil {
+				logger.Debug("Successfully sent callback")
+				return
+			}
+			if _, ok := err.(permanentError); ok || attempt >= h.callbackRetries {
+				logger.WithError(err).Error("Failed to send callback")
+				return
+			}
+			logger.WithError(err).WithField("retry_in", backoff).Warn("Failed to send callback, retrying")
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+// permanentError is returned for callback
+// failures that should not be retried.
+type permanentError struct {
+	error
+}
+
+func (h DockerHook) postCallback(u string, body []byte) error {
+	resp, err := h.callbackClient.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			if _, ok := urlErr.Err.(permanentError); ok {
+				return urlErr.Err
+			}
+		}
+		return err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return permanentError{errors.Errorf("unexpected status %s", resp.Status)}
+}
+
+// checkRedirect prevents redirects from
+// leading callbacks to other hosts.
+func (h DockerHook) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return permanentError{errors.New("too many redirects")}
+	}
+	return h.checkCallbackURL(req.URL)
+}
+
+// checkCallbackURL checks that the URL is
+// an HTTP URL of an allowed host.
+func (h DockerHook) checkCallbackURL(u *url.URL) error {
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return permanentError{errors.Errorf("unsupported callback URL scheme %q", u.Scheme)}
+	}
+	host := strings.ToLower(u.Host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range h.callbackHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed != "" && (allowed == host || allowed == hostname) {
+			return nil
+		}
+	}
+	return permanentError{errors.Errorf("callback host %q not in allowlist", u.Host)}
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// GenericSource is the Source of webhooks with arbitrary JSON bodies,
+// such as those sent with curl from CI pipelines. The repository, tag
+// and digest of the push are extracted from the body with expressions.
+type GenericSource struct {
+	repository expression
+	tag        expression
+	digest     expression
+}
+
+// NewGenericSource creates a GenericSource from the expressions extracting
+// the repository, tag and digest of the push from the request body.
+// Expressions are either JSONPaths such as $.image.tags[0], or
+// templates such as {{ .repo }}, executed with the decoded body.
+// The repository is required. If the tag expression is empty, the
+// tag is latest, and if the digest expression is empty, the push
+// has no digest.
+func NewGenericSource(repository, tag, digest string) (*GenericSource, error) {
+	if repository == "" {
+		return nil, errors.New("missing repository expression")
+	}
+	var g GenericSource
+	for _, e := range []struct {
+		name string
+		expr string
+		dst  *expression
+	}{
+		{"repository", repository, &g.repository},
+		{"tag", tag, &g.tag},
+		{"digest", digest, &g.digest},
+	} {
+		if e.expr == "" {
+			continue
+		}
+		var err error
+		*e.dst, err = parseExpression(e.expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s expression %q", e.name, e.expr)
+		}
+	}
+	return &g, nil
+}
+
+// Pushes implements Source.
+func (g GenericSource) Pushes(_ *http.Request, body []byte) ([]deploy.Push, error) {
+	var data interface{}
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	var push deploy.Push
+	for _, e := range []struct {
+		name string
+		expr expression
+		dst  *string
+	}{
+		{"repository", g.repository, &push.Repository},
+		{"tag", g.tag, &push.Tag},
+		{"digest", g.digest, &push.Digest},
+	} {
+		if e.expr == nil {
+			continue
+		}
+		*e.dst, err = e.expr.evaluate(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to evaluate %s expression", e.name)
+		}
+	}
+
+	if push.Repository == "" {
+		return nil, errors.New("request has no repository")
+	}
+	if push.Tag == "" {
+		push.Tag = "latest"
+	}
+
+	return []deploy.Push{push}, nil
+}
+
+// Authenticator implements Source.
+func (GenericSource) Authenticator(token string) Authenticator {
+	return TokenAuthenticator{
+		Token:  token,
+		Header: "X-Redeploy-Token",
+		Param:  "token",
+	}
+}
+
+// expression extracts a value from a decoded JSON body.
+type expression interface {
+	evaluate(data interface{}) (string, error)
+}
+
+func parseExpression(s string) (expression, error) {
+	if strings.HasPrefix(s, "$") {
+		return parseJSONPath(s)
+	}
+	t, err := template.New("").Option("missingkey=zero").Funcs(template.FuncMap{
+		"lower":      strings.ToLower,
+		"trimPrefix": strings.TrimPrefix,
+		"trimSuffix": strings.TrimSuffix,
+	}).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return templateExpression{t}, nil
+}
+
+// templateExpression is a text/template executed with the body.
+type templateExpression struct {
+	*template.Template
+}
+
+func (t templateExpression) evaluate(data interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	// Missing keys of maps are rendered as <no value>
+	return strings.TrimSpace(strings.Replace(buf.String(), "<no value>", "", -1)), nil
+}
+
+// jsonPath is a JSONPath of object keys and array indices,
+// such as $.push_data.tag or $.images[0].name.
+type jsonPath []interface{}
+
+func parseJSONPath(s string) (jsonPath, error) {
+	var p jsonPath
+	rest := strings.TrimPrefix(s, "$")
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errors.New("empty key")
+			}
+			p, rest = append(p, rest[:end]), rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, errors.New("unterminated index")
+			}
+			index := rest[1:end]
+			if len(index) >= 2 && (index[0] == '\'' || index[0] == '"') && index[len(index)-1] == index[0] {
+				p = append(p, index[1:len(index)-1])
+			} else {
+				i, err := strconv.Atoi(index)
+				if err != nil || i < 0 {
+					return nil, errors.Errorf("invalid index %q", index)
+				}
+				p = append(p, i)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, errors.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return p, nil
+}
+
+// evaluate returns the value at the path. Missing
+// values evaluate to the empty string.
+func (p jsonPath) evaluate(data interface{}) (string, error) {
+	v := data
+	for _, elem := range p {
+		switch e := elem.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return "", nil
+			}
+			v = m[e]
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || e >= len(a) {
+				return "", nil
+			}
+			v = a[e]
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64, bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", errors.New("value is not a string")
+}
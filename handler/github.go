@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// GitHubSignatureHeader is the header GitHub sends
+// the HMAC-SHA256 signature of webhook requests in.
+const GitHubSignatureHeader = "X-Hub-Signature-256"
+
+// GitHubSource is the Source of package webhooks from GitHub, sent
+// when images are published to the GitHub Container Registry. Both
+// the package and the legacy registry_package events are understood,
+// and published tags are deployed pinned to their digest. GitHub
+// signs requests with the secret of the webhook.
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#package
+type GitHubSource struct{}
+
+// Pushes implements Source. Ping events
+// and other events return no pushes.
+func (GitHubSource) Pushes(req *http.Request, body []byte) ([]deploy.Push, error) {
+	event := req.Header.Get("X-GitHub-Event")
+	if event != "package" && event != "registry_package" {
+		return nil, nil
+	}
+
+	var hook GitHubPackageEvent
+	err := json.Unmarshal(body, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := hook.Package
+	if event == "registry_package" {
+		pkg = hook.RegistryPackage
+	}
+	if pkg == nil {
+		return nil, errors.Errorf("%s event has no package", event)
+	}
+
+	if hook.Action != "published" && hook.Action != "updated" {
+		return nil, nil
+	}
+	tag := pkg.PackageVersion.ContainerMetadata.Tag
+	if !strings.EqualFold(pkg.PackageType, "container") || tag.Name == "" {
+		// Other packages and untagged pushes, such as the
+		// platform manifests of multi-platform images.
+		return nil, nil
+	}
+
+	return []deploy.Push{{
+		Repository: pkg.repository(),
+		Tag:        tag.Name,
+		Digest:     tag.Digest,
+		Pusher:     hook.Sender.Login,
+	}}, nil
+}
+
+// Authenticator implements Source.
+func (GitHubSource) Authenticator(secret string) Authenticator {
+	return HMACAuthenticator{
+		Secret: []byte(secret),
+		Header: GitHubSignatureHeader,
+	}
+}
+
+// GitHubPackageEvent is the structure of the JSON sent with the
+// package and registry_package webhook events of GitHub.
+type GitHubPackageEvent struct {
+	Action string `json:"action"`
+	// Package is set for package events.
+	Package *GitHubPackage `json:"package"`
+	// RegistryPackage is set for registry_package events.
+	RegistryPackage *GitHubPackage `json:"registry_package"`
+	Sender          GitHubUser     `json:"sender"`
+}
+
+// GitHubPackage describes the package that was published.
+type GitHubPackage struct {
+	Name           string               `json:"name"`
+	PackageType    string               `json:"package_type"`
+	Owner          GitHubUser           `json:"owner"`
+	PackageVersion GitHubPackageVersion `json:"package_version"`
+	Registry       GitHubRegistry       `json:"registry"`
+}
+
+// GitHubPackageVersion describes the published version of the package.
+type GitHubPackageVersion struct {
+	Version           string                  `json:"version"`
+	PackageURL        string                  `json:"package_url"`
+	ContainerMetadata GitHubContainerMetadata `json:"container_metadata"`
+}
+
+// GitHubContainerMetadata describes the published image.
+type GitHubContainerMetadata struct {
+	Tag GitHubContainerTag `json:"tag"`
+}
+
+// GitHubContainerTag is the tag and digest of the published image.
+type GitHubContainerTag struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// GitHubRegistry describes the registry the package was published to.
+type GitHubRegistry struct {
+	URL string `json:"url"`
+}
+
+// GitHubUser is a GitHub user or organization.
+type GitHubUser struct {
+	Login string `json:"login"`
+}
+
+// repository returns the name of the repository of the image,
+// which is the package URL without its tag or digest.
+// Repository names are always lower case in the registry.
+func (p GitHubPackage) repository() string {
+	repo := p.PackageVersion.PackageURL
+	if repo == "" {
+		// The registry URL includes the owner
+		host := strings.TrimPrefix(strings.TrimPrefix(p.Registry.URL, "https://"), "http://")
+		if i := strings.Index(host, "/"); i >= 0 {
+			host = host[:i]
+		}
+		if host == "" {
+			host = "ghcr.io"
+		}
+		repo = host + "/" + p.Owner.Login + "/" + p.Name
+	}
+	return strings.ToLower(trimReference(repo))
+}
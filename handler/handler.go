@@ -1,23 +1,32 @@
 package handler
 
 import (
-	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
-	"github.com/fsouza/go-dockerclient"
 	"github.com/sirupsen/logrus"
 
-	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/deploy"
 )
 
+// maxBodySize limits the size of webhook request bodies.
+const maxBodySize = 1 << 20
+
 // DockerHook handles incoming requests from the Docker
 // webhook API.
 type DockerHook struct {
-	logger         *logrus.Logger
-	client         *docker.Client
-	imageToService map[string][]config.Service
+	logger          *logrus.Logger
+	deployer        *deploy.Deployer
+	auth            []Authenticator
+	callbackClient  *http.Client
+	callbackHosts   []string
+	callbackRetries int
+	callbackBackoff time.Duration
+	jobsURL         string
 }
 
 // DockerHookOption is used to configure specific options
@@ -31,181 +40,122 @@ func WithLogger(l *logrus.Logger) DockerHookOption {
 	}
 }
 
-// New creates a new DockerHook and connects to
-// the docker host. Set DOCKER_HOST to configure
-// a custom docker endpoint.
-func New(conf *config.Config, opts ...DockerHookOption) (*DockerHook, error) {
-	d := &DockerHook{
-		imageToService: map[string][]config.Service{},
-		logger:         logrus.New(),
+// WithAuthenticators configures authenticators that all
+// have to accept a request before it is acted upon.
+func WithAuthenticators(auth ...Authenticator) DockerHookOption {
+	return func(d *DockerHook) {
+		d.auth = append(d.auth, auth...)
 	}
-	d.logger.Out = ioutil.Discard
+}
 
-	for _, opt := range opts {
-		opt(d)
+// New creates a new DockerHook which queues deploy
+// jobs with the provided Deployer. The outcome of each
+// request is posted to its callback URL, if the host
+// of the URL is allowed.
+func New(d *deploy.Deployer, opts ...DockerHookOption) (*DockerHook, error) {
+	h := &DockerHook{
+		deployer:        d,
+		logger:          logrus.New(),
+		callbackHosts:   []string{DockerHubCallbackHost},
+		callbackRetries: 5,
+		callbackBackoff: time.Second,
 	}
+	h.logger.Out = ioutil.Discard
 
-	for _, service := range conf.Services {
-		d.imageToService[service.Image] = append(d.imageToService[service.Image], service)
-
-		// Check now so we don't have to check later
-		_, err := service.CreateContainerOptions()
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	var err error
-	d.client, err = docker.NewClientFromEnv()
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(h)
 	}
 
-	err = d.client.Ping()
-	if err != nil {
-		return nil, err
+	h.callbackClient = &http.Client{
+		Timeout:       30 * time.Second,
+		CheckRedirect: h.checkRedirect,
 	}
 
-	return d, nil
+	return h, nil
 }
 
 func (h DockerHook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	body, ok := authenticate(h.logger, h.auth, resp, req)
+	if !ok {
+		return
+	}
+
 	var hook HookRequest
-	dec := json.NewDecoder(req.Body)
-	err := dec.Decode(&hook)
+	err := json.Unmarshal(body, &hook)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to decode request")
 		http.Error(resp, "invalid request", http.StatusBadRequest)
 		return
 	}
-	defer func() {
-		err = req.Body.Close()
-		if err != nil {
-			h.logger.WithError(err).Error("Failed to close request body")
-			return
-		}
-	}()
 
 	h.logger.WithField("repo", hook.Repository.RepoURL).Debug("Request received")
 
-	image := hook.Repository.RepoName + ":" + hook.PushData.Tag
-	foundServices, ok := h.imageToService[image]
-	if !ok && hook.PushData.Tag == "latest" {
-		// For images of latest tag, tag is optional.
-		foundServices, ok = h.imageToService[hook.Repository.RepoName]
+	push := deploy.Push{
+		Repository: hook.Repository.RepoName,
+		Tag:        hook.PushData.Tag,
+		Pusher:     hook.PushData.Pusher,
 	}
-	if !ok {
-		h.logger.WithField("image", image).Warn("Got deploy request for image not in config. " +
+	job, err := h.deployer.Enqueue(push, func(job deploy.Job) {
+		h.callback(hook.CallbackURL, h.jobCallback(job))
+	})
+	if err == deploy.ErrNoServices {
+		h.logger.WithField("image", push.Image()).Warn("Got deploy request for image not in config. " +
 			"Have you added it to your config?")
 		resp.WriteHeader(http.StatusOK)
-		_, err = http.Get(hook.CallbackURL)
-		if err != nil {
-			h.logger.WithError(err).Error("Failed to send success to CallbackURL")
-		}
+		h.callback(hook.CallbackURL, Callback{
+			State:       CallbackSuccess,
+			Description: fmt.Sprintf("No services configured for %s", push.Image()),
+			Context:     callbackContext,
+		})
 		return
 	}
-
-	ctx := context.Background()
-	pullOpts := docker.PullImageOptions{
-		Repository:   hook.Repository.RepoName,
-		Tag:          hook.PushData.Tag,
-		Context:      ctx,
-		OutputStream: h.logger.Out,
-	}
-
-	h.logger.WithField("image", image).Debug("Pulling image")
-
-	err = h.client.PullImage(pullOpts, docker.AuthConfiguration{})
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to pull image")
+		h.logger.WithError(err).Error("Failed to queue job")
 		http.Error(resp, "internal error", http.StatusInternalServerError)
+		h.callback(hook.CallbackURL, Callback{
+			State:       CallbackError,
+			Description: "Failed to queue deploy",
+			Context:     callbackContext,
+		})
 		return
 	}
 
-	for _, service := range foundServices {
-		containers, err := h.client.ListContainers(docker.ListContainersOptions{
-			All:     true,
-			Context: ctx,
-		})
-		if err != nil {
-			h.logger.WithError(err).Error("Failed to list running containers")
-			// Soldier on anyway
-		} else {
-			h.logger.Debug("Listed running containers")
-		}
-
-		var id string
-		for _, container := range containers {
-			if sliceContains(container.Names, "/"+service.Name) {
-				h.logger.WithField("name", service.Name).Debug("Found existing container")
-				id = container.ID
-				break
-			}
-		}
-
-		if id != "" {
-			// Container with same name exists, stop and remove it
-			err = h.client.StopContainerWithContext(id, 10, ctx)
-			if err != nil {
-				h.logger.WithError(err).Error("Failed to stop running container")
-				// Soldier on anyway
-			} else {
-				h.logger.WithField("name", service.Name).Debug("Stopped existing container")
-			}
-
-			err = h.client.RemoveContainer(docker.RemoveContainerOptions{
-				ID:      id,
-				Context: ctx,
-			})
-			if err != nil {
-				h.logger.WithError(err).Error("Failed to remove existing container")
-				// Soldier on anyway
-			} else {
-				h.logger.WithField("name", service.Name).Debug("Deleted existing container")
-			}
-		}
-
-		// Error is checked on startup, can't error now.
-		cOpts, _ := service.CreateContainerOptions()
-		cOpts.Context = ctx
-
-		c, err := h.client.CreateContainer(cOpts)
-		if err != nil {
-			h.logger.WithError(err).Error("Failed to create new container")
-			http.Error(resp, "internal error", http.StatusInternalServerError)
-			return
-		}
-
-		h.logger.WithField("name", service.Name).Debug("Created container")
+	writeAccepted(h.logger, resp, job)
+}
 
-		err = h.client.StartContainerWithContext(c.ID, nil, ctx)
+// authenticate reads the body of the request and checks it against
+// all authenticators. If the request is rejected, an error has
+// already been written to resp.
+func authenticate(logger *logrus.Logger, auth []Authenticator, resp http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	defer func() {
+		err := req.Body.Close()
 		if err != nil {
-			h.logger.WithError(err).Error("Failed to start container")
-			http.Error(resp, "internal error", http.StatusInternalServerError)
+			logger.WithError(err).Error("Failed to close request body")
 			return
 		}
+	}()
 
-		h.logger.WithField("name", service.Name).Debug("Started container")
-	}
-
-	resp.WriteHeader(http.StatusOK)
-	_, err = http.Get(hook.CallbackURL)
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize))
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to send success to CallbackURL")
-		return
+		logger.WithError(err).Error("Failed to read request")
+		http.Error(resp, "invalid request", http.StatusBadRequest)
+		return nil, false
 	}
 
-	h.logger.WithField("repo", hook.Repository.RepoName).Debug("Successfully sent callback")
-}
-
-func sliceContains(slice []string, in string) bool {
-	for _, s := range slice {
-		if s == in {
-			return true
+	for _, a := range auth {
+		err = a.Authenticate(req, body)
+		if err != nil {
+			logger.WithError(err).WithField("remote", req.RemoteAddr).Warn("Rejected request")
+			code := http.StatusUnauthorized
+			if authErr, ok := err.(AuthError); ok {
+				code = authErr.Code
+			}
+			http.Error(resp, http.StatusText(code), code)
+			return nil, false
 		}
 	}
 
-	return false
+	return body, true
 }
 
 // HookRequest is the structure of the JSON sent
@@ -2,14 +2,19 @@ package handler_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/cli/cli/compose/types"
 	"github.com/fsouza/go-dockerclient"
@@ -17,7 +22,10 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/deploy"
 	"github.com/johanbrandhorst/redeploy/handler"
+	"github.com/johanbrandhorst/redeploy/history"
+	"github.com/johanbrandhorst/redeploy/internal/dockertest"
 )
 
 type createContainerReq struct {
@@ -83,6 +91,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	checks := checkCalls{}
+	done := make(chan struct{})
 
 	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 		dec := json.NewDecoder(req.Body)
@@ -106,6 +115,15 @@ func TestHandler(t *testing.T) {
 			if diff := deep.Equal(expected, req.URL.Query()); diff != nil {
 				t.Errorf("Unexpected Pull request:\n%v", strings.Join(diff, "\n"))
 			}
+		case "/images/test/test1:latest/json":
+			t.Log("Got InspectImage")
+			err := enc.Encode(&docker.Image{
+				ID:          "sha256:5678",
+				RepoDigests: []string{"test/test1@sha256:abcd"},
+			})
+			if err != nil {
+				t.Error(err)
+			}
 		case "/containers/json":
 			t.Log("Got ListContainers")
 			checks.listCalled = true
@@ -115,7 +133,7 @@ func TestHandler(t *testing.T) {
 			if diff := deep.Equal(expected, req.URL.Query()); diff != nil {
 				t.Errorf("Unexpected ListContainers request:\n%v", strings.Join(diff, "\n"))
 			}
-			err = enc.Encode([]docker.APIContainers{{
+			err := enc.Encode([]docker.APIContainers{{
 				ID:    "1234",
 				Names: []string{"/test"},
 			}})
@@ -135,6 +153,13 @@ func TestHandler(t *testing.T) {
 				HostConfig:       containerOpts.HostConfig,
 				NetworkingConfig: containerOpts.NetworkingConfig,
 			}
+			// Containers are created from the pulled digest
+			expected.Config.Image = "test/test1@sha256:abcd"
+			expected.Config.Labels = map[string]string{
+				deploy.DigestLabel:  "sha256:abcd",
+				deploy.ImageLabel:   "test/test1:latest",
+				deploy.ServiceLabel: "test",
+			}
 			if diff := deep.Equal(expected, cr); diff != nil {
 				t.Errorf("Unexpected CreateContainer request:\n%v", strings.Join(diff, "\n"))
 			}
@@ -156,6 +181,18 @@ func TestHandler(t *testing.T) {
 		case "/containers/1234/start":
 			t.Log("Got StartContainer")
 			checks.startCalled = true
+		case "/containers/1234/json":
+			t.Log("Got InspectContainer")
+			err := enc.Encode(&docker.Container{
+				ID: "1234",
+				State: docker.State{
+					Running:   true,
+					StartedAt: time.Now().Add(-time.Minute),
+				},
+			})
+			if err != nil {
+				t.Error(err)
+			}
 		case "/containers/1234/stop":
 			t.Log("Got StopContainer")
 			checks.stopCalled = true
@@ -165,6 +202,23 @@ func TestHandler(t *testing.T) {
 		case "/callback":
 			t.Log("Got success callback")
 			checks.callbackCalled = true
+			var c handler.Callback
+			err := dec.Decode(&c)
+			if err != nil {
+				t.Error(err)
+			}
+			expected := handler.Callback{
+				State:       handler.CallbackSuccess,
+				Description: "Deployed test/test1:latest@sha256:abcd to test",
+				Context:     "redeploy",
+			}
+			if req.Method != http.MethodPost {
+				t.Errorf("Got callback method %q, expected %q", req.Method, http.MethodPost)
+			}
+			if diff := deep.Equal(expected, c); diff != nil {
+				t.Errorf("Unexpected callback:\n%v", strings.Join(diff, "\n"))
+			}
+			close(done)
 		default:
 			t.Errorf("Got unexpected request for path %q", req.URL.Path)
 			resp.WriteHeader(http.StatusBadRequest)
@@ -178,7 +232,13 @@ func TestHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	hook, err := handler.New(conf, handler.WithLogger(logger))
+	d, err := deploy.New(conf, deploy.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	hook, err := handler.New(d, handler.WithLogger(logger), handler.WithCallbackHosts(strings.TrimPrefix(s.URL, "http://")))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -203,7 +263,1187 @@ func TestHandler(t *testing.T) {
 
 	hook.ServeHTTP(rec, req)
 
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Got status %d, expected %d", rec.Code, http.StatusAccepted)
+	}
+	var job deploy.Job
+	err = json.NewDecoder(rec.Body).Decode(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Location") != handler.JobsPath+job.ID {
+		t.Errorf("Unexpected Location header %q", rec.Header().Get("Location"))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for callback")
+	}
+
 	if err = checks.Validate(); err != nil {
 		t.Error(err)
 	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, handler.JobsPath+job.ID, nil)
+	handler.NewJobs(d, logger).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d", rec.Code, http.StatusOK)
+	}
+	err = json.NewDecoder(rec.Body).Decode(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != deploy.StateSucceeded {
+		t.Errorf("Got job state %q, expected %q", job.State, deploy.StateSucceeded)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, handler.JobsPath+"unknown", nil)
+	handler.NewJobs(d, logger).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, expected %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer s.Close()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(&handler.HookRequest{
+		CallbackURL: s.URL + "/callback",
+		PushData: handler.PushData{
+			Tag: "latest",
+		},
+		Repository: handler.Repository{
+			RepoName: "test/unknown",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	allowlist, err := handler.ParseIPAllowlist([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denylist, err := handler.ParseIPAllowlist([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenAuth := handler.TokenAuthenticator{
+		Token:  "secret",
+		Header: "X-Redeploy-Token",
+		Param:  "token",
+	}
+	hmacAuth := handler.HMACAuthenticator{
+		Secret: []byte("secret"),
+		Header: "X-Redeploy-Signature",
+	}
+
+	testCases := []struct {
+		Name     string
+		Auth     []handler.Authenticator
+		URL      string
+		Headers  map[string]string
+		Expected int
+	}{
+		{
+			Name:     "No authentication",
+			URL:      s.URL,
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "Token in query",
+			Auth:     []handler.Authenticator{tokenAuth},
+			URL:      s.URL + "?token=secret",
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "Token in header",
+			Auth:     []handler.Authenticator{tokenAuth},
+			URL:      s.URL,
+			Headers:  map[string]string{"X-Redeploy-Token": "secret"},
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "Missing token",
+			Auth:     []handler.Authenticator{tokenAuth},
+			URL:      s.URL,
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Name:     "Invalid token",
+			Auth:     []handler.Authenticator{tokenAuth},
+			URL:      s.URL + "?token=secre",
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Name:     "Valid signature",
+			Auth:     []handler.Authenticator{hmacAuth},
+			URL:      s.URL,
+			Headers:  map[string]string{"X-Redeploy-Signature": signature},
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "Invalid signature",
+			Auth:     []handler.Authenticator{hmacAuth},
+			URL:      s.URL,
+			Headers:  map[string]string{"X-Redeploy-Signature": "sha256=abcdef"},
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Name:     "Missing signature",
+			Auth:     []handler.Authenticator{hmacAuth},
+			URL:      s.URL,
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Name:     "Allowed IP",
+			Auth:     []handler.Authenticator{allowlist},
+			URL:      s.URL,
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "Disallowed IP",
+			Auth:     []handler.Authenticator{denylist},
+			URL:      s.URL,
+			Expected: http.StatusForbidden,
+		},
+		{
+			Name:     "All required",
+			Auth:     []handler.Authenticator{allowlist, tokenAuth, hmacAuth},
+			URL:      s.URL + "?token=secret",
+			Headers:  map[string]string{"X-Redeploy-Signature": signature},
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "One of several fails",
+			Auth:     []handler.Authenticator{allowlist, tokenAuth, hmacAuth},
+			URL:      s.URL,
+			Headers:  map[string]string{"X-Redeploy-Signature": signature},
+			Expected: http.StatusUnauthorized,
+		},
+	}
+
+	d, err := deploy.New(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, testCase := range testCases {
+		hook, err := handler.New(d, handler.WithAuthenticators(testCase.Auth...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, testCase.URL, bytes.NewReader(body))
+		for k, v := range testCase.Headers {
+			req.Header.Set(k, v)
+		}
+
+		hook.ServeHTTP(rec, req)
+
+		if rec.Code != testCase.Expected {
+			t.Errorf("For %s: got status %d, expected %d", testCase.Name, rec.Code, testCase.Expected)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevImage := s.AddImage("test/test1")
+	s.AddContainer("test", "test/test1")
+	// Containers created from the new image crash on startup
+	s.SetExitCode("test/test1", 1)
+
+	conf := &config.Config{
+		Config: types.Config{
+			Version: "3.0",
+		},
+		Services: []config.Service{
+			{
+				Name:  "test",
+				Image: "test/test1",
+			},
+		},
+	}
+
+	d, err := deploy.New(conf, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	hook, err := handler.New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(&handler.HookRequest{
+		PushData: handler.PushData{
+			Tag: "latest",
+		},
+		Repository: handler.Repository{
+			RepoName: "test/test1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	hook.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Got status %d, expected %d", rec.Code, http.StatusAccepted)
+	}
+
+	var job deploy.Job
+	err = json.NewDecoder(rec.Body).Decode(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := handler.NewJobs(d, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.State.Done() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rec = httptest.NewRecorder()
+		jobs.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, handler.JobsPath+job.ID, nil))
+		err = json.NewDecoder(rec.Body).Decode(&job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if job.State != deploy.StateFailed {
+		t.Fatalf("Got job state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if job.RolledBack["test"] != prevImage {
+		t.Errorf("Got rolled back image %q, expected %q", job.RolledBack["test"], prevImage)
+	}
+
+	c, ok := s.Container("test")
+	if !ok {
+		t.Fatal("Service container does not exist")
+	}
+	if c.Image != prevImage {
+		t.Errorf("Got container image %q, expected %q", c.Image, prevImage)
+	}
+	if !c.State.Running {
+		t.Error("Rolled back container is not running")
+	}
+	if len(s.Containers()) != 1 {
+		t.Errorf("Got containers %v, expected only the rolled back container", s.Containers())
+	}
+}
+
+func TestAPI(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.AddContainer("test", "test/test1")
+
+	conf := &config.Config{
+		Config: types.Config{
+			Version: "3.0",
+		},
+		Services: []config.Service{
+			{
+				Name:  "test",
+				Image: "test/test1",
+			},
+		},
+	}
+
+	d, err := deploy.New(conf, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	api := handler.NewAPI(d, nil, handler.TokenAuthenticator{
+		Token:  "secret",
+		Header: "X-Redeploy-Token",
+	})
+
+	for _, testCase := range []struct {
+		Name     string
+		Method   string
+		URL      string
+		Token    string
+		Expected int
+	}{
+		{"List", http.MethodGet, "/services", "secret", http.StatusOK},
+		{"Unauthenticated", http.MethodGet, "/services", "", http.StatusUnauthorized},
+		{"WrongMethod", http.MethodPost, "/services", "secret", http.StatusMethodNotAllowed},
+		{"Redeploy", http.MethodPost, "/services/test/redeploy", "secret", http.StatusAccepted},
+		{"RedeployGet", http.MethodGet, "/services/test/redeploy", "secret", http.StatusMethodNotAllowed},
+		{"RedeployUnknown", http.MethodPost, "/services/missing/redeploy", "secret", http.StatusNotFound},
+		{"Rollback", http.MethodPost, "/services/test/rollback?to=v1", "secret", http.StatusAccepted},
+		{"RollbackMissingTo", http.MethodPost, "/services/test/rollback", "secret", http.StatusBadRequest},
+		{"UnknownAction", http.MethodPost, "/services/test/restart", "secret", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(testCase.Method, testCase.URL, nil)
+		if testCase.Token != "" {
+			req.Header.Set("X-Redeploy-Token", testCase.Token)
+		}
+
+		api.ServeHTTP(rec, req)
+
+		if rec.Code != testCase.Expected {
+			t.Errorf("For %s: got status %d, expected %d", testCase.Name, rec.Code, testCase.Expected)
+			continue
+		}
+
+		switch rec.Code {
+		case http.StatusOK:
+			var statuses []deploy.ServiceStatus
+			err = json.NewDecoder(rec.Body).Decode(&statuses)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(statuses) != 1 || statuses[0].Name != "test" || statuses[0].State != "running" {
+				t.Errorf("For %s: unexpected services: %+v", testCase.Name, statuses)
+			}
+		case http.StatusAccepted:
+			var job deploy.Job
+			err = json.NewDecoder(rec.Body).Decode(&job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Header().Get("Location") != handler.JobsPath+job.ID {
+				t.Errorf("For %s: got Location %q, expected %q", testCase.Name, rec.Header().Get("Location"), handler.JobsPath+job.ID)
+			}
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now().UTC()
+	err = store.Add(
+		history.Record{Job: "1", Service: "test", Finished: now.Add(-48 * time.Hour)},
+		history.Record{Job: "2", Service: "other", Finished: now},
+		history.Record{Job: "3", Service: "test", Finished: now},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := handler.NewHistory(store, nil)
+	for _, testCase := range []struct {
+		Name     string
+		URL      string
+		Expected int
+		Jobs     []string
+	}{
+		{"All", "/history", http.StatusOK, []string{"1", "2", "3"}},
+		{"Service", "/history?service=test", http.StatusOK, []string{"1", "3"}},
+		{"SinceDuration", "/history?since=24h", http.StatusOK, []string{"2", "3"}},
+		{"SinceTime", "/history?service=test&since=" + now.Add(-time.Hour).Format(time.RFC3339), http.StatusOK, []string{"3"}},
+		{"InvalidSince", "/history?since=yesterday", http.StatusBadRequest, nil},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, testCase.URL, nil))
+		if rec.Code != testCase.Expected {
+			t.Errorf("For %s: got status %d, expected %d", testCase.Name, rec.Code, testCase.Expected)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		var records []history.Record
+		err = json.NewDecoder(rec.Body).Decode(&records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jobs []string
+		for _, r := range records {
+			jobs = append(jobs, r.Job)
+		}
+		if diff := deep.Equal(jobs, testCase.Jobs); diff != nil {
+			t.Errorf("For %s:\n%v", testCase.Name, strings.Join(diff, "\n"))
+		}
+	}
+}
+
+func TestRegistryHook(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const image = "registry.example.com:5000/test/test1"
+	s.AddImage(image)
+	s.AddContainer("test", image)
+	pushed := s.Push(image)
+
+	conf := &config.Config{
+		Config: types.Config{
+			Version: "3.0",
+		},
+		Services: []config.Service{
+			{
+				Name:  "test",
+				Image: image,
+			},
+		},
+	}
+
+	d, err := deploy.New(conf, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	auth := handler.RegistrySource{}.Authenticator("secret")
+
+	event := func(action, mediaType, host string) handler.Event {
+		return handler.Event{
+			Action: action,
+			Target: handler.EventTarget{
+				MediaType:  mediaType,
+				Digest:     pushed,
+				Repository: "test/test1",
+				Tag:        "latest",
+			},
+			Request: handler.EventRequest{
+				Host: host,
+			},
+			Actor: handler.EventActor{
+				Name: "pusher",
+			},
+		}
+	}
+	const manifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	for _, testCase := range []struct {
+		Name     string
+		Host     string
+		Token    string
+		Events   []handler.Event
+		Expected int
+		Jobs     int
+	}{
+		{
+			Name:  "Push",
+			Token: "secret",
+			Events: []handler.Event{
+				event("push", "application/octet-stream", "registry.example.com:5000"),
+				event("pull", manifest, "registry.example.com:5000"),
+				event("push", manifest, "registry.example.com:5000"),
+			},
+			Expected: http.StatusAccepted,
+			Jobs:     1,
+		},
+		{
+			Name:  "ConfiguredHost",
+			Host:  "registry.example.com:5000",
+			Token: "secret",
+			Events: []handler.Event{
+				event("push", manifest, "localhost:5000"),
+			},
+			Expected: http.StatusAccepted,
+			Jobs:     1,
+		},
+		{
+			Name:  "OtherHost",
+			Token: "secret",
+			Events: []handler.Event{
+				event("push", manifest, "localhost:5000"),
+			},
+			Expected: http.StatusOK,
+		},
+		{
+			Name: "Unauthenticated",
+			Events: []handler.Event{
+				event("push", manifest, "registry.example.com:5000"),
+			},
+			Expected: http.StatusUnauthorized,
+		},
+	} {
+		hook := handler.NewHook(d, handler.RegistrySource{Host: testCase.Host}, nil, auth)
+
+		body, err := json.Marshal(&handler.Envelope{Events: testCase.Events})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/registry", bytes.NewReader(body))
+		if testCase.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+testCase.Token)
+		}
+		hook.ServeHTTP(rec, req)
+
+		if rec.Code != testCase.Expected {
+			t.Errorf("For %s: got status %d, expected %d", testCase.Name, rec.Code, testCase.Expected)
+			continue
+		}
+		if rec.Code != http.StatusAccepted {
+			continue
+		}
+
+		var jobs []deploy.Job
+		err = json.NewDecoder(rec.Body).Decode(&jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != testCase.Jobs {
+			t.Errorf("For %s: got %d jobs, expected %d", testCase.Name, len(jobs), testCase.Jobs)
+			continue
+		}
+
+		job := jobs[0]
+		if job.Push.Digest != pushed || job.Push.Pusher != "pusher" {
+			t.Errorf("For %s: unexpected push %+v", testCase.Name, job.Push)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !job.State.Done() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			job, _ = d.Job(job.ID)
+		}
+		if job.State != deploy.StateSucceeded {
+			t.Errorf("For %s: got job state %q, expected %q", testCase.Name, job.State, deploy.StateSucceeded)
+		}
+
+		c, ok := s.Container("test")
+		if !ok {
+			t.Fatalf("For %s: service container does not exist", testCase.Name)
+		}
+		if c.Image != pushed {
+			t.Errorf("For %s: got container image %q, expected %q", testCase.Name, c.Image, pushed)
+		}
+		if c.Config.Image != image+"@"+pushed || c.Config.Labels[deploy.DigestLabel] != pushed {
+			t.Errorf("For %s: container not pinned to digest: %q, %v", testCase.Name, c.Config.Image, c.Config.Labels)
+		}
+	}
+
+	// Pushes whose digest doesn't match the pulled image fail
+	stale := event("push", manifest, "registry.example.com:5000")
+	stale.Target.Digest = "sha256:stale"
+	body, err := json.Marshal(&handler.Envelope{Events: []handler.Event{stale}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/registry", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.NewHook(d, handler.RegistrySource{}, nil, auth).ServeHTTP(rec, req)
+	var jobs []deploy.Job
+	err = json.NewDecoder(rec.Body).Decode(&jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Got %d jobs, expected 1", len(jobs))
+	}
+	job := jobs[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.State.Done() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = d.Job(job.ID)
+	}
+	if job.State != deploy.StateFailed {
+		t.Errorf("Got job state %q, expected %q", job.State, deploy.StateFailed)
+	}
+	if len(job.Errors) != 1 || !strings.Contains(job.Errors[0].Error, "sha256:stale") {
+		t.Errorf("Got errors %v, expected digest mismatch", job.Errors)
+	}
+}
+
+func TestGitHubHook(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const image = "ghcr.io/test/test1"
+	s.AddImage(image)
+	s.AddContainer("test", image)
+	pushed := s.Push(image)
+
+	conf := &config.Config{
+		Config: types.Config{
+			Version: "3.0",
+		},
+		Services: []config.Service{
+			{
+				Name:  "test",
+				Image: image,
+			},
+		},
+	}
+
+	d, err := deploy.New(conf, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	hook := handler.NewHook(d, handler.GitHubSource{}, nil, handler.GitHubSource{}.Authenticator("secret"))
+
+	fixture, err := ioutil.ReadFile("testdata/github-package.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := strings.Replace(string(fixture), "sha256:DIGEST", pushed, -1)
+
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		_, _ = mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, testCase := range []struct {
+		Name      string
+		Event     string
+		Body      string
+		Signature string
+		Expected  int
+	}{
+		{
+			Name:     "Ping",
+			Event:    "ping",
+			Body:     `{"zen":"Keep it logically awesome.","hook_id":1}`,
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "Published",
+			Event:    "package",
+			Body:     published,
+			Expected: http.StatusAccepted,
+		},
+		{
+			Name:     "RegistryPackage",
+			Event:    "registry_package",
+			Body:     strings.Replace(published, `"package":`, `"registry_package":`, 1),
+			Expected: http.StatusAccepted,
+		},
+		{
+			Name:     "Updated",
+			Event:    "package",
+			Body:     strings.Replace(published, `"action": "published"`, `"action": "updated"`, 1),
+			Expected: http.StatusAccepted,
+		},
+		{
+			Name:     "NotContainer",
+			Event:    "package",
+			Body:     strings.Replace(published, `"package_type": "CONTAINER"`, `"package_type": "npm"`, 1),
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "OtherImage",
+			Event:    "package",
+			Body:     strings.Replace(published, "ghcr.io/test/test1:latest", "ghcr.io/test/other:latest", -1),
+			Expected: http.StatusOK,
+		},
+		{
+			Name:      "InvalidSignature",
+			Event:     "package",
+			Body:      published,
+			Signature: sign("other"),
+			Expected:  http.StatusUnauthorized,
+		},
+		{
+			Name:     "InvalidBody",
+			Event:    "package",
+			Body:     `{"package":`,
+			Expected: http.StatusBadRequest,
+		},
+	} {
+		signature := testCase.Signature
+		if signature == "" {
+			signature = sign(testCase.Body)
+		}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/github", strings.NewReader(testCase.Body))
+		req.Header.Set("X-GitHub-Event", testCase.Event)
+		req.Header.Set(handler.GitHubSignatureHeader, signature)
+		hook.ServeHTTP(rec, req)
+
+		if rec.Code != testCase.Expected {
+			t.Errorf("For %s: got status %d, expected %d", testCase.Name, rec.Code, testCase.Expected)
+			continue
+		}
+		if rec.Code != http.StatusAccepted {
+			continue
+		}
+
+		var jobs []deploy.Job
+		err = json.NewDecoder(rec.Body).Decode(&jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 1 {
+			t.Errorf("For %s: got %d jobs, expected 1", testCase.Name, len(jobs))
+			continue
+		}
+		job := jobs[0]
+		expected := deploy.Push{
+			Repository: image,
+			Tag:        "latest",
+			Digest:     pushed,
+			Pusher:     "pusher",
+		}
+		if diff := deep.Equal(job.Push, expected); diff != nil {
+			t.Errorf("For %s: %v", testCase.Name, diff)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !job.State.Done() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			job, _ = d.Job(job.ID)
+		}
+		if job.State != deploy.StateSucceeded {
+			t.Errorf("For %s: got job state %q, expected %q", testCase.Name, job.State, deploy.StateSucceeded)
+		}
+
+		c, ok := s.Container("test")
+		if !ok {
+			t.Fatalf("For %s: service container does not exist", testCase.Name)
+		}
+		if c.Image != pushed {
+			t.Errorf("For %s: got container image %q, expected %q", testCase.Name, c.Image, pushed)
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	for _, testCase := range []struct {
+		Format   string
+		Fixture  string
+		Auth     func(req *http.Request)
+		Expected []deploy.Push
+	}{
+		{
+			Format:  "gitlab",
+			Fixture: "testdata/gitlab-registry.json",
+			Auth: func(req *http.Request) {
+				req.Header.Set("X-Gitlab-Token", "secret")
+			},
+			Expected: []deploy.Push{{
+				Repository: "registry.gitlab.example.com/group/project/test1",
+				Tag:        "v1.2.3",
+				Digest:     "sha256:3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b",
+				Pusher:     "pusher",
+			}},
+		},
+		{
+			Format:  "harbor",
+			Fixture: "testdata/harbor-push-artifact.json",
+			Auth: func(req *http.Request) {
+				req.Header.Set("Authorization", "secret")
+			},
+			Expected: []deploy.Push{{
+				Repository: "harbor.example.com/library/test1",
+				Tag:        "v1.2.3",
+				Digest:     "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+				Pusher:     "pusher",
+			}},
+		},
+		{
+			Format:  "quay",
+			Fixture: "testdata/quay-repo-push.json",
+			Auth: func(req *http.Request) {
+				req.URL.RawQuery = "token=secret"
+			},
+			Expected: []deploy.Push{
+				{
+					Repository: "quay.io/test/test1",
+					Tag:        "latest",
+				},
+				{
+					Repository: "quay.io/test/test1",
+					Tag:        "v1.2.3",
+				},
+			},
+		},
+	} {
+		source, err := handler.NewSource(testCase.Format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadFile(testCase.Fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/"+testCase.Format, bytes.NewReader(body))
+		auth := source.Authenticator("secret")
+		if err := auth.Authenticate(req, body); err == nil {
+			t.Errorf("For %s: unauthenticated request was accepted", testCase.Format)
+		}
+		testCase.Auth(req)
+		if err := auth.Authenticate(req, body); err != nil {
+			t.Errorf("For %s: authenticated request was rejected: %v", testCase.Format, err)
+		}
+
+		pushes, err := source.Pushes(req, body)
+		if err != nil {
+			t.Errorf("For %s: unexpected error: %v", testCase.Format, err)
+			continue
+		}
+		if diff := deep.Equal(pushes, testCase.Expected); diff != nil {
+			t.Errorf("For %s: %v", testCase.Format, diff)
+		}
+	}
+
+	// Other Harbor events are ignored
+	body, err := ioutil.ReadFile("testdata/harbor-push-artifact.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.Replace(body, []byte("PUSH_ARTIFACT"), []byte("DELETE_ARTIFACT"), 1)
+	pushes, err := handler.HarborSource{}.Pushes(httptest.NewRequest(http.MethodPost, "/harbor", nil), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pushes) != 0 {
+		t.Errorf("Got pushes %v for deleted artifact, expected none", pushes)
+	}
+
+	if _, err := handler.NewSource("dockerhub"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestGenericSource(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/generic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		Name                    string
+		Repository, Tag, Digest string
+		Expected                deploy.Push
+		Error                   bool
+	}{
+		{
+			Name:       "JSONPath",
+			Repository: "$.image.name",
+			Tag:        "$.image.tags[0]",
+			Digest:     "$['image']['digest']",
+			Expected: deploy.Push{
+				Repository: "Registry.Example.com/test/test1",
+				Tag:        "1.2.3",
+				Digest:     "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+			},
+		},
+		{
+			Name:       "Template",
+			Repository: "{{ lower .image.name }}",
+			Tag:        "build-{{ .build.number }}",
+			Expected: deploy.Push{
+				Repository: "registry.example.com/test/test1",
+				Tag:        "build-42",
+			},
+		},
+		{
+			Name:       "NumberAndDefaultTag",
+			Repository: "$.image.name",
+			Tag:        "$.image.missing",
+			Expected: deploy.Push{
+				Repository: "Registry.Example.com/test/test1",
+				Tag:        "latest",
+			},
+		},
+		{
+			Name:       "MissingRepository",
+			Repository: "{{ .missing }}",
+			Error:      true,
+		},
+		{
+			Name:       "NotAString",
+			Repository: "$.image",
+			Error:      true,
+		},
+	} {
+		source, err := handler.NewGenericSource(testCase.Repository, testCase.Tag, testCase.Digest)
+		if err != nil {
+			t.Errorf("For %s: unexpected error: %v", testCase.Name, err)
+			continue
+		}
+
+		pushes, err := source.Pushes(httptest.NewRequest(http.MethodPost, "/generic", nil), body)
+		if testCase.Error {
+			if err == nil {
+				t.Errorf("For %s: expected error", testCase.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("For %s: unexpected error: %v", testCase.Name, err)
+			continue
+		}
+		if diff := deep.Equal(pushes, []deploy.Push{testCase.Expected}); diff != nil {
+			t.Errorf("For %s: %v", testCase.Name, diff)
+		}
+	}
+
+	for _, expr := range []string{"", "$.", "$.image[", "$.image[-1]", "$image", "{{ .image"} {
+		if _, err := handler.NewGenericSource(expr, "", ""); err == nil {
+			t.Errorf("For %q: expected error", expr)
+		}
+	}
+}
+
+func TestCallback(t *testing.T) {
+	s := dockertest.NewServer()
+	defer s.Close()
+
+	err := os.Setenv("DOCKER_HOST", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevImage := s.AddImage("test/test1")
+	s.AddContainer("test", "test/test1")
+	// Containers created from the new image crash on startup
+	s.SetExitCode("test/test1", 1)
+	s.AddImage("test/policy:1.4.9")
+	s.AddContainer("policy", "test/policy:1.4.9")
+
+	conf := &config.Config{
+		Config: types.Config{
+			Version: "3.0",
+		},
+		Services: []config.Service{
+			{
+				Name:  "test",
+				Image: "test/test1",
+			},
+			{
+				Name:   "policy",
+				Image:  "test/policy:1.4.2",
+				Labels: map[string]string{config.TagPolicyLabel: "semver:~1.4"},
+			},
+		},
+	}
+
+	d, err := deploy.New(conf, deploy.WithMonitor(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	forbidden := make(chan string, 10)
+	other := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		forbidden <- req.URL.Path
+	}))
+	defer other.Close()
+
+	callbacks := make(chan handler.Callback, 10)
+	var failed bool
+	cb := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/redirect":
+			http.Redirect(resp, req, other.URL+"/redirected", http.StatusFound)
+			return
+		case "/flaky":
+			if !failed {
+				failed = true
+				http.Error(resp, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		var c handler.Callback
+		err := json.NewDecoder(req.Body).Decode(&c)
+		if err != nil {
+			t.Error(err)
+		}
+		callbacks <- c
+	}))
+	defer cb.Close()
+
+	hook, err := handler.New(d,
+		handler.WithCallbackHosts(strings.TrimPrefix(cb.URL, "http://")),
+		handler.WithCallbackRetries(3, 10*time.Millisecond),
+		handler.WithJobsURL("https://redeploy.example.com/jobs/"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(repo, tag, callbackURL string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(&handler.HookRequest{
+			CallbackURL: callbackURL,
+			PushData: handler.PushData{
+				Tag: tag,
+			},
+			Repository: handler.Repository{
+				RepoName: repo,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		hook.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		return rec
+	}
+	receive := func() handler.Callback {
+		select {
+		case c := <-callbacks:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for callback")
+		}
+		return handler.Callback{}
+	}
+
+	// Failures are reported, after retrying the callback
+	rec := push("test/test1", "latest", cb.URL+"/flaky")
+	var job deploy.Job
+	err = json.NewDecoder(rec.Body).Decode(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := receive()
+	if c.State != handler.CallbackFailure || c.Context != "redeploy" {
+		t.Errorf("Got callback %+v, expected failure", c)
+	}
+	if !strings.HasPrefix(c.Description, "Failed to deploy test/test1:latest") || !strings.Contains(c.Description, "test: ") {
+		t.Errorf("Got description %q, expected failure naming the service", c.Description)
+	}
+	if !strings.Contains(c.Description, ", rolled back test to "+prevImage+": ") {
+		t.Errorf("Got description %q, expected rollback of the service to %q", c.Description, prevImage)
+	}
+	if c.TargetURL != "https://redeploy.example.com/jobs/"+job.ID {
+		t.Errorf("Got target URL %q, expected link to job %q", c.TargetURL, job.ID)
+	}
+
+	// Pushes of older tags than are deployed are skipped
+	push("test/policy", "1.4.7", cb.URL+"/callback")
+	c = receive()
+	if !strings.HasPrefix(c.Description, "Skipped test/policy:1.4.7") || !strings.HasSuffix(c.Description, ", newer tags are deployed to policy at 1.4.9") {
+		t.Errorf("Got description %q, expected skip of older tag", c.Description)
+	}
+
+	// Images not in the config are reported too
+	push("test/other", "latest", cb.URL+"/callback")
+	c = receive()
+	expected := handler.Callback{
+		State:       handler.CallbackSuccess,
+		Description: "No services configured for test/other:latest",
+		Context:     "redeploy",
+	}
+	if diff := deep.Equal(c, expected); diff != nil {
+		t.Error(strings.Join(diff, "\n"))
+	}
+
+	// Callbacks are never sent to other hosts
+	push("test/other", "latest", other.URL+"/callback")
+	push("test/other", "latest", cb.URL+"/redirect")
+	push("test/other", "latest", cb.URL+"/callback")
+	receive()
+	select {
+	case path := <-forbidden:
+		t.Errorf("Got callback to host not in allowlist on %q", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	routes := handler.NewRoutes(http.NewServeMux())
+	h := http.NotFoundHandler()
+	for _, r := range []struct {
+		name string
+		path string
+	}{
+		{"dockerhub", "/"},
+		{"registry", "/registry"},
+		{"gitlab", "/hooks/gitlab"},
+		{"jobs", handler.JobsPath},
+		{"services", handler.ServicesPath},
+		{"services", handler.ServicesPath + "/"},
+	} {
+		if err := routes.Handle(r.name, r.path, h); err != nil {
+			t.Fatalf("Failed to register %s: %v", r.name, err)
+		}
+	}
+
+	for _, testCase := range []struct {
+		Name  string
+		Path  string
+		Error string
+	}{
+		{
+			Name:  "Duplicate",
+			Path:  "/registry",
+			Error: "webhook: path /registry conflicts with path /registry of registry",
+		},
+		{
+			Name:  "WithinSubtree",
+			Path:  "/jobs/gitlab",
+			Error: "webhook: path /jobs/gitlab conflicts with path /jobs/ of jobs",
+		},
+		{
+			Name:  "ContainsPath",
+			Path:  "/hooks/",
+			Error: "webhook: path /hooks/ conflicts with path /hooks/gitlab of gitlab",
+		},
+		{
+			Name:  "Relative",
+			Path:  "gitlab",
+			Error: `webhook: path "gitlab" does not start with /`,
+		},
+	} {
+		err := routes.Handle("webhook", testCase.Path, h)
+		if err == nil || err.Error() != testCase.Error {
+			t.Errorf("For %s: got error %v, expected %q", testCase.Name, err, testCase.Error)
+		}
+	}
+
+	// Paths within the root don't conflict with it
+	if err := routes.Handle("webhook", "/gitlab", h); err != nil {
+		t.Error(err)
+	}
 }
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// HarborSource is the Source of webhooks sent by Harbor. Tags
+// pushed with PUSH_ARTIFACT events are deployed pinned to their
+// digest. Harbor sends the auth header configured for the webhook
+// as the Authorization header.
+// https://goharbor.io/docs/main/working-with-projects/project-configuration/configure-webhooks/
+type HarborSource struct{}
+
+// Pushes implements Source. Events other
+// than PUSH_ARTIFACT return no pushes.
+func (HarborSource) Pushes(_ *http.Request, body []byte) ([]deploy.Push, error) {
+	var hook HarborEvent
+	err := json.Unmarshal(body, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	if hook.Type != "PUSH_ARTIFACT" {
+		return nil, nil
+	}
+
+	var pushes []deploy.Push
+	for _, resource := range hook.EventData.Resources {
+		if resource.Tag == "" {
+			continue
+		}
+		pushes = append(pushes, deploy.Push{
+			Repository: trimReference(resource.ResourceURL),
+			Tag:        resource.Tag,
+			Digest:     resource.Digest,
+			Pusher:     hook.Operator,
+		})
+	}
+
+	return pushes, nil
+}
+
+// Authenticator implements Source.
+func (HarborSource) Authenticator(token string) Authenticator {
+	return TokenAuthenticator{
+		Token:  token,
+		Header: "Authorization",
+	}
+}
+
+// HarborEvent is the structure of the JSON sent with Harbor webhooks.
+type HarborEvent struct {
+	Type      string          `json:"type"`
+	OccurAt   int64           `json:"occur_at"`
+	Operator  string          `json:"operator"`
+	EventData HarborEventData `json:"event_data"`
+}
+
+// HarborEventData describes the artifacts of the event.
+type HarborEventData struct {
+	Resources  []HarborResource `json:"resources"`
+	Repository HarborRepository `json:"repository"`
+}
+
+// HarborResource describes a pushed artifact. The resource URL
+// is the full reference of the artifact, including the host.
+type HarborResource struct {
+	Digest      string `json:"digest"`
+	Tag         string `json:"tag"`
+	ResourceURL string `json:"resource_url"`
+}
+
+// HarborRepository describes the repository of the artifacts.
+type HarborRepository struct {
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	RepoFullName string `json:"repo_full_name"`
+	RepoType     string `json:"repo_type"`
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/history"
+)
+
+// HistoryPath is the path the History handler should be served on.
+const HistoryPath = "/history"
+
+// History serves the deploy history on GET /history.
+// The optional service parameter limits the records to a
+// single service, and the optional since parameter, either
+// an RFC 3339 timestamp or a duration such as 24h, limits
+// the records to those that finished after that point in time.
+type History struct {
+	logger *logrus.Logger
+	store  *history.Store
+	auth   []Authenticator
+}
+
+// NewHistory creates a new History handler serving the records
+// of the provided store. If logger is nil, nothing is logged.
+func NewHistory(s *history.Store, logger *logrus.Logger, auth ...Authenticator) *History {
+	if logger == nil {
+		logger = logrus.New()
+		logger.Out = ioutil.Discard
+	}
+	return &History{
+		logger: logger,
+		store:  s,
+		auth:   auth,
+	}
+}
+
+func (h History) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, ok := authenticate(h.logger, h.auth, resp, req)
+	if !ok {
+		return
+	}
+
+	var since time.Time
+	if s := req.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = parseSince(s)
+		if err != nil {
+			http.Error(resp, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records := h.store.Query(req.URL.Query().Get("service"), since)
+
+	writeJSON(h.logger, resp, http.StatusOK, records)
+}
+
+// parseSince parses either an RFC 3339 timestamp
+// or a duration relative to the current time.
+func parseSince(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	d, dErr := time.ParseDuration(s)
+	if dErr != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-d), nil
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// JobsPath is the path prefix the Jobs handler should be served on.
+const JobsPath = "/jobs/"
+
+// Jobs serves the state of deploy jobs on GET /jobs/{id}.
+type Jobs struct {
+	logger   *logrus.Logger
+	deployer *deploy.Deployer
+	auth     []Authenticator
+}
+
+// NewJobs creates a new Jobs handler reporting the jobs
+// of the provided Deployer. If logger is nil, nothing is logged.
+func NewJobs(d *deploy.Deployer, logger *logrus.Logger, auth ...Authenticator) *Jobs {
+	if logger == nil {
+		logger = logrus.New()
+		logger.Out = ioutil.Discard
+	}
+	return &Jobs{
+		logger:   logger,
+		deployer: d,
+		auth:     auth,
+	}
+}
+
+func (j Jobs) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, ok := authenticate(j.logger, j.auth, resp, req)
+	if !ok {
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, JobsPath)
+	job, ok := j.deployer.Job(id)
+	if !ok {
+		http.Error(resp, "job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(j.logger, resp, http.StatusOK, job)
+}
+
+// writeAccepted answers a webhook request with the
+// ID of the job that was queued for it.
+func writeAccepted(logger *logrus.Logger, resp http.ResponseWriter, job deploy.Job) {
+	resp.Header().Set("Location", JobsPath+job.ID)
+	writeJSON(logger, resp, http.StatusAccepted, job)
+}
+
+func writeJSON(logger *logrus.Logger, resp http.ResponseWriter, code int, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	err := json.NewEncoder(resp).Encode(v)
+	if err != nil {
+		logger.WithError(err).Error("Failed to write response")
+	}
+}
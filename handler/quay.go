@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// QuaySource is the Source of repository push notifications sent
+// by Quay. Each updated tag is deployed. Quay does not support
+// custom headers, so the token is read from the token query parameter.
+// https://docs.quay.io/guides/notifications.html
+type QuaySource struct{}
+
+// Pushes implements Source.
+func (QuaySource) Pushes(_ *http.Request, body []byte) ([]deploy.Push, error) {
+	var hook QuayRepoPush
+	err := json.Unmarshal(body, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	if hook.DockerURL == "" {
+		return nil, errors.New("repository push has no docker_url")
+	}
+
+	var pushes []deploy.Push
+	for _, tag := range hook.UpdatedTags {
+		pushes = append(pushes, deploy.Push{
+			Repository: hook.DockerURL,
+			Tag:        tag,
+		})
+	}
+
+	return pushes, nil
+}
+
+// Authenticator implements Source.
+func (QuaySource) Authenticator(token string) Authenticator {
+	return TokenAuthenticator{
+		Token: token,
+		Param: "token",
+	}
+}
+
+// QuayRepoPush is the structure of the JSON sent
+// with the repo_push notification of Quay.
+type QuayRepoPush struct {
+	Name        string   `json:"name"`
+	Repository  string   `json:"repository"`
+	Namespace   string   `json:"namespace"`
+	DockerURL   string   `json:"docker_url"`
+	Homepage    string   `json:"homepage"`
+	UpdatedTags []string `json:"updated_tags"`
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// manifestTypes are the media types of the manifests
+// pushed for images, as opposed to their layers.
+var manifestTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.v1+json":      true,
+	"application/vnd.docker.distribution.manifest.v1+prettyjws": true,
+	"application/vnd.docker.distribution.manifest.v2+json":      true,
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	"application/vnd.oci.image.manifest.v1+json":                true,
+	"application/vnd.oci.image.index.v1+json":                   true,
+}
+
+// RegistrySource is the Source of notifications sent by a Docker
+// Distribution registry, such as the registry:2 image. Manifest
+// pushes of tags are deployed pinned to the pushed digest.
+// The registry authenticates with a bearer token.
+// https://docs.docker.com/registry/notifications/
+type RegistrySource struct {
+	// Host prefixes the pushed repositories to match the images
+	// of the services. If empty, the host the image was pushed
+	// to, as reported by the registry, is used instead.
+	Host string
+}
+
+// Pushes implements Source.
+func (r RegistrySource) Pushes(_ *http.Request, body []byte) ([]deploy.Push, error) {
+	return envelopePushes(body, func(event Event) string {
+		if r.Host != "" {
+			return r.Host
+		}
+		return event.Request.Host
+	})
+}
+
+// Authenticator implements Source.
+func (r RegistrySource) Authenticator(token string) Authenticator {
+	return TokenAuthenticator{
+		Token:  token,
+		Header: "Authorization",
+		Prefix: "Bearer ",
+	}
+}
+
+// GitLabSource is the Source of notifications sent by the container
+// registry of GitLab, which uses the envelope of Docker Distribution.
+// The host of pushed repositories is read from the URL of the
+// pushed manifest, and the registry authenticates with the
+// X-Gitlab-Token header.
+type GitLabSource struct{}
+
+// Pushes implements Source.
+func (GitLabSource) Pushes(_ *http.Request, body []byte) ([]deploy.Push, error) {
+	return envelopePushes(body, func(event Event) string {
+		u, err := url.Parse(event.Target.URL)
+		if err != nil || u.Host == "" {
+			return event.Request.Host
+		}
+		return u.Host
+	})
+}
+
+// Authenticator implements Source.
+func (GitLabSource) Authenticator(token string) Authenticator {
+	return TokenAuthenticator{
+		Token:  token,
+		Header: "X-Gitlab-Token",
+	}
+}
+
+// envelopePushes returns the manifest pushes of tags in the envelope,
+// prefixing repositories with the host returned for the event.
+func envelopePushes(body []byte, host func(Event) string) ([]deploy.Push, error) {
+	var envelope Envelope
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	var pushes []deploy.Push
+	for _, event := range envelope.Events {
+		if event.Action != "push" || !manifestTypes[event.Target.MediaType] || event.Target.Tag == "" {
+			// Layer pushes, pulls, deletes and pushes by digest
+			// don't change the image of any tag.
+			continue
+		}
+
+		repo := event.Target.Repository
+		if h := strings.TrimSuffix(host(event), "/"); h != "" {
+			repo = h + "/" + repo
+		}
+		pushes = append(pushes, deploy.Push{
+			Repository: repo,
+			Tag:        event.Target.Tag,
+			Digest:     event.Target.Digest,
+			Pusher:     event.Actor.Name,
+		})
+	}
+
+	return pushes, nil
+}
+
+// Envelope is the structure of the JSON sent
+// with registry notifications.
+type Envelope struct {
+	Events []Event `json:"events"`
+}
+
+// Event describes a single action on the registry.
+type Event struct {
+	ID        string       `json:"id"`
+	Timestamp string       `json:"timestamp"`
+	Action    string       `json:"action"`
+	Target    EventTarget  `json:"target"`
+	Request   EventRequest `json:"request"`
+	Actor     EventActor   `json:"actor"`
+}
+
+// EventTarget describes the content the action was taken on.
+type EventTarget struct {
+	MediaType  string `json:"mediaType"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest"`
+	Repository string `json:"repository"`
+	URL        string `json:"url"`
+	Tag        string `json:"tag"`
+}
+
+// EventRequest describes the request that triggered the action.
+type EventRequest struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	Host      string `json:"host"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent"`
+}
+
+// EventActor describes the user that triggered the action.
+type EventActor struct {
+	Name string `json:"name"`
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Routes registers the handlers of endpoints on a ServeMux,
+// returning an error where the ServeMux would panic, or where
+// one endpoint would shadow another.
+type Routes struct {
+	mux   *http.ServeMux
+	paths []string
+	names map[string]string
+}
+
+// NewRoutes creates Routes registering handlers on mux.
+func NewRoutes(mux *http.ServeMux) *Routes {
+	return &Routes{
+		mux:   mux,
+		names: map[string]string{},
+	}
+}
+
+// Handle registers the handler of the named endpoint on the path,
+// which has to start with a slash. An error is returned if the path
+// is already used by another endpoint, or if either path is within
+// the subtree of the other. The root path, which serves all paths
+// not served by other endpoints, is the exception.
+func (r *Routes) Handle(name, path string, h http.Handler) error {
+	if !strings.HasPrefix(path, "/") {
+		return errors.Errorf("%s: path %q does not start with /", name, path)
+	}
+	for _, p := range r.paths {
+		if p == path || within(path, p) || within(p, path) {
+			return errors.Errorf("%s: path %s conflicts with path %s of %s", name, path, p, r.names[p])
+		}
+	}
+	r.paths = append(r.paths, path)
+	r.names[path] = name
+	r.mux.Handle(path, h)
+	return nil
+}
+
+// within returns whether the path is within the subtree of the pattern.
+func within(path, pattern string) bool {
+	return pattern != "/" && strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)
+}
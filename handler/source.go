@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/johanbrandhorst/redeploy/deploy"
+)
+
+// Source translates the webhook requests of a registry
+// or CI system into the images that were pushed.
+type Source interface {
+	// Pushes returns the pushes described by the request.
+	// Requests that describe no push, such as pings or
+	// pulls, return no pushes and no error.
+	Pushes(req *http.Request, body []byte) ([]deploy.Push, error)
+	// Authenticator returns an Authenticator requiring the
+	// secret token the way the source sends it.
+	Authenticator(token string) Authenticator
+}
+
+// NewSource returns the Source of the named webhook format,
+// one of registry, github, gitlab, harbor or quay. Sources
+// of the generic format are created with NewGenericSource.
+func NewSource(format string) (Source, error) {
+	switch format {
+	case "registry":
+		return RegistrySource{}, nil
+	case "github":
+		return GitHubSource{}, nil
+	case "gitlab":
+		return GitLabSource{}, nil
+	case "harbor":
+		return HarborSource{}, nil
+	case "quay":
+		return QuaySource{}, nil
+	}
+	return nil, errors.Errorf("unknown webhook format %q", format)
+}
+
+// Hook handles webhook requests from a Source, queueing a
+// deploy job for each pushed image. Requests are answered
+// with the list of queued jobs.
+type Hook struct {
+	logger   *logrus.Logger
+	deployer *deploy.Deployer
+	source   Source
+	auth     []Authenticator
+}
+
+// NewHook creates a new Hook which queues deploy jobs for the pushes
+// of the source with the provided Deployer. If logger is nil,
+// nothing is logged.
+func NewHook(d *deploy.Deployer, source Source, logger *logrus.Logger, auth ...Authenticator) *Hook {
+	if logger == nil {
+		logger = logrus.New()
+		logger.Out = ioutil.Discard
+	}
+	return &Hook{
+		logger:   logger,
+		deployer: d,
+		source:   source,
+		auth:     auth,
+	}
+}
+
+func (h Hook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := authenticate(h.logger, h.auth, resp, req)
+	if !ok {
+		return
+	}
+
+	pushes, err := h.source.Pushes(req, body)
+	if err != nil {
+		h.logger.WithError(err).WithField("path", req.URL.Path).Error("Failed to decode request")
+		http.Error(resp, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	jobs := []deploy.Job{}
+	for _, push := range pushes {
+		logger := h.logger.WithFields(logrus.Fields{
+			"image":  push.Image(),
+			"tag":    push.Tag,
+			"pusher": push.Pusher,
+		})
+		logger.Debug("Push received")
+
+		job, err := h.deployer.Enqueue(push, nil)
+		if err == deploy.ErrNoServices {
+			logger.Warn("Got deploy request for image not in config. " +
+				"Have you added it to your config?")
+			continue
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to queue job")
+			http.Error(resp, "internal error", http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(jobs) == 0 {
+		resp.WriteHeader(http.StatusOK)
+		return
+	}
+
+	writeJSON(h.logger, resp, http.StatusAccepted, jobs)
+}
+
+// trimReference returns the repository of an image
+// reference, without its tag or digest.
+func trimReference(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	// A colon after the last slash separates the tag
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
@@ -0,0 +1,291 @@
+// Package history implements a persistent record of deploys.
+// Records are stored as lines of JSON in a single file, which is
+// appended to as deploys finish and rewritten when old records
+// are dropped according to the configured retention.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileName is the name of the file the history
+// is stored in within the state directory.
+const FileName = "history.jsonl"
+
+// Step records when a deploy entered a step.
+type Step struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// Record describes an attempt to deploy an image to a service.
+type Record struct {
+	Job        string `json:"job"`
+	Service    string `json:"service"`
+	Image      string `json:"image"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Pusher     string `json:"pusher,omitempty"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	// RolledBack is the ID of the image the service
+	// was recreated from after the deploy failed.
+	RolledBack string    `json:"rolled_back,omitempty"`
+	Steps      []Step    `json:"steps"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+}
+
+// Store is a persistent store of deploy records.
+type Store struct {
+	path       string
+	maxRecords int
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	records []Record
+	// lines is the number of records in the file,
+	// including those dropped from records.
+	lines int
+}
+
+// StoreOption is used to configure the retention of a Store.
+type StoreOption func(*Store)
+
+// WithMaxRecords configures the number of records to keep.
+// Older records are dropped first. Defaults to no limit.
+func WithMaxRecords(n int) StoreOption {
+	return func(s *Store) {
+		s.maxRecords = n
+	}
+}
+
+// WithMaxAge configures how long records are kept
+// after they finished. Defaults to no limit.
+func WithMaxAge(t time.Duration) StoreOption {
+	return func(s *Store) {
+		s.maxAge = t
+	}
+}
+
+// Open opens the history stored in the directory,
+// creating the directory and the store if necessary.
+func Open(dir string, opts ...StoreOption) (*Store, error) {
+	s := &Store{
+		path: filepath.Join(dir, FileName),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create state directory")
+	}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.prune()
+	if s.lines > len(s.records) {
+		err = s.compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open history")
+	}
+
+	return s, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Add appends records to the store. If the records were
+// stored but the file could not be compacted afterwards,
+// an error is returned all the same.
+func (s *Store) Add(records ...Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+
+	_, err := s.file.Write(buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to write history")
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "failed to write history")
+	}
+
+	s.records = append(s.records, records...)
+	s.lines += len(records)
+
+	s.prune()
+	// Rewriting the file for every dropped record would
+	// be wasteful, so let dropped records accumulate
+	// until they make up half the file.
+	if s.lines > 2*len(s.records) {
+		// The records are stored even if this fails, and
+		// compacting is tried again with the next records.
+		return s.compact()
+	}
+
+	return nil
+}
+
+// Query returns the records of the service that finished
+// at or after since, oldest first. If service is empty, records
+// of all services are returned. If since is zero, all records
+// are returned.
+func (s *Store) Query(service string, since time.Time) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []Record{}
+	for _, r := range s.records {
+		if service != "" && r.Service != service {
+			continue
+		}
+		if r.Finished.Before(since) {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return records
+}
+
+// load reads the records from the file, if it exists.
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to open history")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		s.lines++
+		var r Record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			// A write was interrupted, the record is lost.
+			// It will be dropped when the file is rewritten.
+			continue
+		}
+		s.records = append(s.records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "failed to read history")
+	}
+
+	return nil
+}
+
+// prune drops records according to the retention. s.mu must be held.
+func (s *Store) prune() {
+	drop := 0
+	if s.maxRecords > 0 && len(s.records) > s.maxRecords {
+		drop = len(s.records) - s.maxRecords
+	}
+	if s.maxAge > 0 {
+		cutoff := time.Now().Add(-s.maxAge)
+		for drop < len(s.records) && s.records[drop].Finished.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		s.records = append([]Record(nil), s.records[drop:]...)
+	}
+}
+
+// compact atomically replaces the file with one
+// containing only the retained records.
+func (s *Store) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), FileName)
+	if err != nil {
+		return errors.Wrap(err, "failed to rewrite history")
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range s.records {
+		err = enc.Encode(r)
+		if err != nil {
+			tmp.Close()
+			return errors.Wrap(err, "failed to rewrite history")
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to rewrite history")
+	}
+
+	var f *os.File
+	if s.file != nil {
+		// Open the new file before replacing the current one,
+		// so that appends keep working if either fails.
+		f, err = os.OpenFile(tmp.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to rewrite history")
+		}
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return errors.Wrap(err, "failed to rewrite history")
+	}
+	if f != nil {
+		_ = s.file.Close()
+		s.file = f
+	}
+
+	s.lines = len(s.records)
+	return nil
+}
@@ -0,0 +1,274 @@
+package history_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/johanbrandhorst/redeploy/history"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func record(job, service string, finished time.Time) history.Record {
+	return history.Record{
+		Job:        job,
+		Service:    service,
+		Image:      "test/test1:latest",
+		Repository: "test/test1",
+		Tag:        "latest",
+		Outcome:    "succeeded",
+		Steps: []history.Step{
+			{Name: "queued", Time: finished.Add(-time.Minute).UTC()},
+		},
+		Started:  finished.Add(-time.Minute).UTC(),
+		Finished: finished.UTC(),
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	first := record("1", "test", now.Add(-time.Hour))
+	second := record("2", "other", now)
+	third := record("2", "test", now)
+	err = s.Add(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(second, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records survive reopening
+	s, err = history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, testCase := range []struct {
+		Name     string
+		Service  string
+		Since    time.Time
+		Expected []history.Record
+	}{
+		{"All", "", time.Time{}, []history.Record{first, second, third}},
+		{"Service", "test", time.Time{}, []history.Record{first, third}},
+		{"Since", "", now.Add(-time.Minute), []history.Record{second, third}},
+		{"ServiceSince", "other", now.Add(-time.Minute), []history.Record{second}},
+		{"None", "missing", time.Time{}, []history.Record{}},
+	} {
+		got := s.Query(testCase.Service, testCase.Since)
+		if diff := deep.Equal(got, testCase.Expected); diff != nil {
+			t.Errorf("For %s:\n%v", testCase.Name, strings.Join(diff, "\n"))
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+
+	t.Run("MaxRecords", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s, err := history.Open(dir, history.WithMaxRecords(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, job := range []string{"1", "2", "3", "4", "5"} {
+			err = s.Add(record(job, "test", now))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []history.Record{record("4", "test", now), record("5", "test", now)}
+		if diff := deep.Equal(s.Query("", time.Time{}), expected); diff != nil {
+			t.Error(strings.Join(diff, "\n"))
+		}
+
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = history.Open(dir, history.WithMaxRecords(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if diff := deep.Equal(s.Query("", time.Time{}), expected); diff != nil {
+			t.Error(strings.Join(diff, "\n"))
+		}
+
+		// Dropped records are removed from the file
+		b, err := ioutil.ReadFile(filepath.Join(dir, history.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(b), "\n"); lines != 2 {
+			t.Errorf("Got %d lines in history file, expected 2", lines)
+		}
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s, err := history.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Add(record("1", "test", now.Add(-48*time.Hour)), record("2", "test", now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = history.Open(dir, history.WithMaxAge(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		expected := []history.Record{record("2", "test", now)}
+		if diff := deep.Equal(s.Query("", time.Time{}), expected); diff != nil {
+			t.Error(strings.Join(diff, "\n"))
+		}
+	})
+}
+
+func TestFailedCompaction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+
+	s, err := history.Open(dir, history.WithMaxRecords(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range []string{"1", "2"} {
+		err = s.Add(record(job, "test", now))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory in place of the file can't be replaced
+	path := filepath.Join(dir, history.FileName)
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(record("3", "test", now)); err == nil {
+		t.Fatal("Expected compaction to fail")
+	}
+
+	// Records are still added after the failure
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(record("4", "test", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(record("5", "test", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = history.Open(dir, history.WithMaxRecords(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expected := []history.Record{record("5", "test", now)}
+	if diff := deep.Equal(s.Query("", time.Time{}), expected); diff != nil {
+		t.Error(strings.Join(diff, "\n"))
+	}
+}
+
+func TestInterruptedWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	s, err := history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(record("1", "test", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, history.FileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"job":"2","serv`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Add(record("3", "test", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []history.Record{record("1", "test", now), record("3", "test", now)}
+	if diff := deep.Equal(s.Query("", time.Time{}), expected); diff != nil {
+		t.Error(strings.Join(diff, "\n"))
+	}
+}
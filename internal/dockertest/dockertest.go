@@ -0,0 +1,865 @@
+// Package dockertest implements a fake Docker daemon for use in tests.
+// It keeps just enough state about images and containers to
+// exercise the deploy logic of redeploy.
+package dockertest
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Server is a fake Docker daemon.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	calls      []string
+	failures   map[string]int
+	images     map[string]*docker.Image
+	containers map[string]*docker.Container
+	networks   map[string]*docker.Network
+	volumes    map[string]*docker.Volume
+	volumeOpts map[string]map[string]string
+	files      map[string]map[string]File
+	health     map[string]string
+	exitCodes  map[string]int
+	auths      map[string]docker.AuthConfiguration
+	remote     map[string]*docker.Image
+	listeners  map[chan docker.APIEvents]bool
+	nextID     int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewServer starts a new fake Docker daemon.
+// Point DOCKER_HOST at its URL to use it.
+func NewServer() *Server {
+	s := &Server{
+		failures:   map[string]int{},
+		images:     map[string]*docker.Image{},
+		containers: map[string]*docker.Container{},
+		networks:   map[string]*docker.Network{},
+		volumes:    map[string]*docker.Volume{},
+		volumeOpts: map[string]map[string]string{},
+		files:      map[string]map[string]File{},
+		health:     map[string]string{},
+		exitCodes:  map[string]int{},
+		auths:      map[string]docker.AuthConfiguration{},
+		remote:     map[string]*docker.Image{},
+		listeners:  map[chan docker.APIEvents]bool{},
+		closed:     make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Close ends any event streams and shuts down the server.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	s.Server.Close()
+}
+
+// Calls returns the calls made to the server so far,
+// in the form "METHOD /path".
+func (s *Server) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// Called reports whether a call has been made to the server.
+func (s *Server) Called(call string) bool {
+	for _, c := range s.Calls() {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail makes the next n calls to the method and path
+// fail with an internal server error.
+func (s *Server) Fail(call string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[call] += n
+}
+
+// AddImage adds an image to the server. The ID of the image is returned.
+func (s *Server) AddImage(ref string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addImage(ref).ID
+}
+
+// Push pushes a new image for the reference to the registry, without
+// pulling it. Pulls of the reference resolve to the pushed image
+// from then on, instead of a new image each time. The ID of the
+// image, which is also its digest, is returned.
+func (s *Server) Push(ref string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img := s.newImage(normalizeRef(ref))
+	s.remote[normalizeRef(ref)] = img
+	return img.ID
+}
+
+// AddContainer adds a running container created from the
+// image with the provided name to the server.
+// The ID of the container is returned.
+func (s *Server) AddContainer(name, image string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.createContainer(name, &docker.Config{Image: image}, &docker.HostConfig{})
+	c.State.Running = true
+	c.State.Status = "running"
+	return c.ID
+}
+
+// AddNetwork adds a network with the provided name to the
+// server, as if created by hand. The ID of the network is returned.
+func (s *Server) AddNetwork(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createNetwork(docker.CreateNetworkOptions{Name: name, Driver: "bridge"}).ID
+}
+
+// Network returns the network with the provided name or ID.
+func (s *Server) Network(nameOrID string) (docker.Network, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.findNetwork(nameOrID)
+	if n == nil {
+		return docker.Network{}, false
+	}
+	return *n, true
+}
+
+// AddVolume adds a volume with the provided
+// name to the server, as if created by hand.
+func (s *Server) AddVolume(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createVolume(docker.CreateVolumeOptions{Name: name})
+}
+
+// Volume returns the volume with the provided name.
+func (s *Server) Volume(name string) (docker.Volume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.volumes[name]
+	if !ok {
+		return docker.Volume{}, false
+	}
+	return *v, true
+}
+
+// VolumeOptions returns the driver options
+// the volume with the provided name was created with.
+func (s *Server) VolumeOptions(name string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.volumeOpts[name]
+}
+
+// SetHealth sets the health status reported by containers
+// with a health check created from the image after they are
+// started. The default is "healthy".
+func (s *Server) SetHealth(image, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health[normalizeRef(image)] = status
+}
+
+// SetExitCode makes containers created from the image
+// exit with the provided code as soon as they are started.
+func (s *Server) SetExitCode(image string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exitCodes[normalizeRef(image)] = code
+}
+
+// RequireAuth makes pulls of the repository fail
+// unless the provided credentials are used.
+func (s *Server) RequireAuth(repository, username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auths[repository] = docker.AuthConfiguration{
+		Username: username,
+		Password: password,
+	}
+}
+
+// Container returns the container with the provided name or ID.
+func (s *Server) Container(nameOrID string) (docker.Container, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.findContainer(nameOrID)
+	if c == nil {
+		return docker.Container{}, false
+	}
+	return *c, true
+}
+
+// File is a file copied or bind-mounted into a container.
+type File struct {
+	Content []byte
+	UID     int
+	GID     int
+	Mode    int64
+}
+
+// File returns the file at the absolute path that was copied
+// into the container with the provided name or ID, or that is
+// bind-mounted into it from the host.
+func (s *Server) File(nameOrID, path string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.findContainer(nameOrID)
+	if c == nil {
+		return File{}, false
+	}
+	if f, ok := s.files[c.ID][path]; ok {
+		return f, true
+	}
+	if c.HostConfig == nil {
+		return File{}, false
+	}
+	for _, m := range c.HostConfig.Mounts {
+		if m.Type == "bind" && m.Target == path {
+			return hostFile(m.Source)
+		}
+	}
+	return File{}, false
+}
+
+// hostFile reads the file at the path on the host.
+func hostFile(name string) (File, bool) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return File{}, false
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return File{}, false
+	}
+	f := File{
+		Content: content,
+		Mode:    int64(info.Mode().Perm()),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		f.UID, f.GID = int(st.Uid), int(st.Gid)
+	}
+	return f, true
+}
+
+// Containers returns the names of all containers.
+func (s *Server) Containers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, c := range s.containers {
+		names = append(names, strings.TrimPrefix(c.Name, "/"))
+	}
+	return names
+}
+
+func normalizeRef(ref string) string {
+	if i := strings.LastIndex(ref, ":"); i < 0 || strings.Contains(ref[i:], "/") {
+		ref += ":latest"
+	}
+	return ref
+}
+
+func (s *Server) addImage(ref string) *docker.Image {
+	ref = normalizeRef(ref)
+	img := s.remote[ref]
+	if img == nil {
+		img = s.newImage(ref)
+	}
+	// Untag any previous image with this reference
+	for _, old := range s.images {
+		for i, tag := range old.RepoTags {
+			if tag == ref {
+				old.RepoTags = append(old.RepoTags[:i], old.RepoTags[i+1:]...)
+				break
+			}
+		}
+	}
+	img.RepoTags = []string{ref}
+	s.images[img.ID] = img
+	return img
+}
+
+func (s *Server) newImage(ref string) *docker.Image {
+	s.nextID++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", ref, s.nextID)))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	repo := ref[:strings.LastIndex(ref, ":")]
+	return &docker.Image{
+		ID:          digest,
+		RepoTags:    []string{ref},
+		RepoDigests: []string{repo + "@" + digest},
+		Created:     time.Now(),
+	}
+}
+
+// refs returns the references settings of the container's image may
+// be configured for: the reference it was created with and the
+// current tags of its image.
+func (s *Server) refs(c *docker.Container) []string {
+	refs := []string{normalizeRef(c.Config.Image)}
+	if img, ok := s.images[c.Image]; ok {
+		refs = append(refs, img.RepoTags...)
+	}
+	return refs
+}
+
+func (s *Server) findImage(ref string) *docker.Image {
+	if img, ok := s.images[ref]; ok {
+		return img
+	}
+	if strings.Contains(ref, "@") {
+		for _, img := range s.images {
+			for _, digest := range img.RepoDigests {
+				if digest == ref {
+					return img
+				}
+			}
+		}
+		return nil
+	}
+	ref = normalizeRef(ref)
+	for _, img := range s.images {
+		for _, tag := range img.RepoTags {
+			if tag == ref {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) createContainer(name string, config *docker.Config, hostConfig *docker.HostConfig) *docker.Container {
+	s.nextID++
+	id := fmt.Sprintf("%064x", s.nextID)
+	c := &docker.Container{
+		ID:         id,
+		Name:       "/" + name,
+		Created:    time.Now(),
+		Config:     config,
+		HostConfig: hostConfig,
+		State: docker.State{
+			Status: "created",
+		},
+	}
+	if img := s.findImage(config.Image); img != nil {
+		c.Image = img.ID
+	}
+	s.containers[id] = c
+	return c
+}
+
+func (s *Server) createNetwork(opts docker.CreateNetworkOptions) *docker.Network {
+	s.nextID++
+	n := &docker.Network{
+		Name:     opts.Name,
+		ID:       fmt.Sprintf("%064x", s.nextID),
+		Scope:    "local",
+		Driver:   opts.Driver,
+		Internal: opts.Internal,
+		Labels:   opts.Labels,
+	}
+	if opts.IPAM != nil {
+		n.IPAM = *opts.IPAM
+	}
+	if len(opts.Options) > 0 {
+		n.Options = map[string]string{}
+		for k, v := range opts.Options {
+			n.Options[k] = fmt.Sprint(v)
+		}
+	}
+	s.networks[n.ID] = n
+	return n
+}
+
+func (s *Server) createVolume(opts docker.CreateVolumeOptions) *docker.Volume {
+	if v, ok := s.volumes[opts.Name]; ok {
+		// Like Docker, creating an existing volume returns it
+		return v
+	}
+	v := &docker.Volume{
+		Name:       opts.Name,
+		Driver:     opts.Driver,
+		Mountpoint: "/var/lib/docker/volumes/" + opts.Name + "/_data",
+		Labels:     opts.Labels,
+	}
+	if v.Driver == "" {
+		v.Driver = "local"
+	}
+	s.volumes[v.Name] = v
+	s.volumeOpts[v.Name] = opts.DriverOpts
+	return v
+}
+
+func (s *Server) findNetwork(nameOrID string) *docker.Network {
+	if n, ok := s.networks[nameOrID]; ok {
+		return n
+	}
+	for _, n := range s.networks {
+		if n.Name == nameOrID {
+			return n
+		}
+	}
+	return nil
+}
+
+// connect connects the container to the network, which
+// must exist unless it is one of the predefined networks.
+func (s *Server) connect(c *docker.Container, name string, endpoint *docker.EndpointConfig) bool {
+	var id string
+	switch n := s.findNetwork(name); {
+	case n != nil:
+		name, id = n.Name, n.ID
+	case name != "bridge" && name != "host" && name != "none":
+		return false
+	}
+	network := docker.ContainerNetwork{NetworkID: id}
+	if endpoint != nil {
+		network.Aliases = endpoint.Aliases
+		if endpoint.IPAMConfig != nil {
+			network.IPAddress = endpoint.IPAMConfig.IPv4Address
+			network.GlobalIPv6Address = endpoint.IPAMConfig.IPv6Address
+		}
+	}
+	if c.NetworkSettings == nil {
+		c.NetworkSettings = &docker.NetworkSettings{}
+	}
+	if c.NetworkSettings.Networks == nil {
+		c.NetworkSettings.Networks = map[string]docker.ContainerNetwork{}
+	}
+	c.NetworkSettings.Networks[name] = network
+	return true
+}
+
+func (s *Server) findContainer(nameOrID string) *docker.Container {
+	if c, ok := s.containers[nameOrID]; ok {
+		return c
+	}
+	for _, c := range s.containers {
+		if c.Name == "/"+nameOrID {
+			return c
+		}
+	}
+	return nil
+}
+
+// emit sends a container event to all event streams. s.mu must be held.
+func (s *Server) emit(action string, c *docker.Container, attributes ...string) {
+	now := time.Now()
+	event := docker.APIEvents{
+		Type:   "container",
+		Action: action,
+		Status: action,
+		ID:     c.ID,
+		From:   c.Config.Image,
+		Actor: docker.APIActor{
+			ID: c.ID,
+			Attributes: map[string]string{
+				"name":  strings.TrimPrefix(c.Name, "/"),
+				"image": c.Config.Image,
+			},
+		},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+	// Like Docker, include the labels of the container
+	for k, v := range c.Config.Labels {
+		event.Actor.Attributes[k] = v
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		event.Actor.Attributes[attributes[i]] = attributes[i+1]
+	}
+	for listener := range s.listeners {
+		select {
+		case listener <- event:
+		default:
+			// Drop events for slow listeners, as Docker does
+		}
+	}
+}
+
+// serveEvents streams events until the client
+// disconnects or the server is closed.
+func (s *Server) serveEvents(resp http.ResponseWriter, req *http.Request) {
+	events := make(chan docker.APIEvents, 100)
+	s.mu.Lock()
+	s.calls = append(s.calls, req.Method+" "+req.URL.Path)
+	s.listeners[events] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, events)
+		s.mu.Unlock()
+	}()
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	flusher, _ := resp.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(resp)
+	for {
+		select {
+		case event := <-events:
+			if enc.Encode(event) != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-req.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Server) serve(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/events" {
+		// Event streams don't hold the lock while open
+		s.serveEvents(resp, req)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	call := req.Method + " " + req.URL.Path
+	s.calls = append(s.calls, call)
+	if s.failures[call] > 0 {
+		s.failures[call]--
+		http.Error(resp, "injected failure", http.StatusInternalServerError)
+		return
+	}
+
+	path := req.URL.Path
+	switch {
+	case path == "/_ping":
+		_, _ = resp.Write([]byte("OK"))
+	case path == "/version":
+		writeJSON(resp, map[string]string{"ApiVersion": "1.25"})
+	case path == "/images/create" && req.Method == http.MethodPost:
+		ref := req.URL.Query().Get("fromImage")
+		tag := req.URL.Query().Get("tag")
+		if required, ok := s.auths[ref]; ok {
+			var auth docker.AuthConfiguration
+			b, _ := base64.URLEncoding.DecodeString(req.Header.Get("X-Registry-Auth"))
+			_ = json.Unmarshal(b, &auth)
+			if auth.Username != required.Username || auth.Password != required.Password {
+				http.Error(resp, "unauthorized: authentication required", http.StatusInternalServerError)
+				return
+			}
+		}
+		if strings.HasPrefix(tag, "sha256:") {
+			// Pull by digest
+			if s.findImage(ref+"@"+tag) == nil {
+				http.Error(resp, "manifest unknown", http.StatusNotFound)
+			}
+			return
+		}
+		if tag != "" {
+			ref += ":" + tag
+		}
+		s.addImage(ref)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		img := s.findImage(strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json"))
+		if img == nil {
+			http.Error(resp, "no such image", http.StatusNotFound)
+			return
+		}
+		writeJSON(resp, img)
+	case path == "/containers/json":
+		var list []docker.APIContainers
+		for _, c := range s.containers {
+			list = append(list, docker.APIContainers{
+				ID:     c.ID,
+				Image:  c.Config.Image,
+				Names:  []string{c.Name},
+				State:  c.State.Status,
+				Labels: c.Config.Labels,
+			})
+		}
+		writeJSON(resp, list)
+	case path == "/networks/create" && req.Method == http.MethodPost:
+		var opts docker.CreateNetworkOptions
+		err := json.NewDecoder(req.Body).Decode(&opts)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.findNetwork(opts.Name) != nil {
+			http.Error(resp, "network with name "+opts.Name+" already exists", http.StatusConflict)
+			return
+		}
+		n := s.createNetwork(opts)
+		writeJSON(resp, map[string]string{"ID": n.ID})
+	case strings.HasPrefix(path, "/networks/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/networks/"), "/", 2)
+		n := s.findNetwork(parts[0])
+		if n == nil {
+			http.Error(resp, "network "+parts[0]+" not found", http.StatusNotFound)
+			return
+		}
+		switch {
+		case len(parts) == 1 && req.Method == http.MethodGet:
+			writeJSON(resp, n)
+		case len(parts) == 2 && parts[1] == "connect" && req.Method == http.MethodPost:
+			var opts docker.NetworkConnectionOptions
+			err := json.NewDecoder(req.Body).Decode(&opts)
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c := s.findContainer(opts.Container)
+			if c == nil {
+				http.Error(resp, "no such container", http.StatusNotFound)
+				return
+			}
+			s.connect(c, n.Name, opts.EndpointConfig)
+			resp.WriteHeader(http.StatusOK)
+		default:
+			http.Error(resp, "not found", http.StatusNotFound)
+		}
+	case path == "/volumes/create" && req.Method == http.MethodPost:
+		var opts docker.CreateVolumeOptions
+		err := json.NewDecoder(req.Body).Decode(&opts)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(resp, s.createVolume(opts))
+	case strings.HasPrefix(path, "/volumes/") && req.Method == http.MethodGet:
+		v, ok := s.volumes[strings.TrimPrefix(path, "/volumes/")]
+		if !ok {
+			http.Error(resp, "no such volume", http.StatusNotFound)
+			return
+		}
+		writeJSON(resp, v)
+	case path == "/containers/create" && req.Method == http.MethodPost:
+		var body struct {
+			*docker.Config
+			HostConfig       *docker.HostConfig
+			NetworkingConfig *docker.NetworkingConfig
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := req.URL.Query().Get("name")
+		if s.findContainer(name) != nil {
+			http.Error(resp, "name already in use", http.StatusConflict)
+			return
+		}
+		if s.findImage(body.Config.Image) == nil {
+			http.Error(resp, "no such image", http.StatusNotFound)
+			return
+		}
+		if body.HostConfig != nil {
+			for _, m := range body.HostConfig.Mounts {
+				if _, err := os.Stat(m.Source); m.Type == "bind" && err != nil {
+					http.Error(resp, "invalid mount config for type \"bind\": bind source path does not exist: "+m.Source, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		c := s.createContainer(name, body.Config, body.HostConfig)
+		if body.HostConfig != nil {
+			// Docker creates missing named volumes with the defaults
+			for _, m := range body.HostConfig.Mounts {
+				if m.Type == "volume" && m.Source != "" {
+					s.createVolume(docker.CreateVolumeOptions{Name: m.Source})
+				}
+			}
+			for _, bind := range body.HostConfig.Binds {
+				if source := strings.SplitN(bind, ":", 2)[0]; !strings.HasPrefix(source, "/") {
+					s.createVolume(docker.CreateVolumeOptions{Name: source})
+				}
+			}
+		}
+		if body.NetworkingConfig != nil {
+			for network, endpoint := range body.NetworkingConfig.EndpointsConfig {
+				if !s.connect(c, network, endpoint) {
+					delete(s.containers, c.ID)
+					http.Error(resp, "network "+network+" not found", http.StatusNotFound)
+					return
+				}
+			}
+		}
+		s.emit("create", c)
+		writeJSON(resp, docker.Container{ID: c.ID})
+	case strings.HasPrefix(path, "/containers/"):
+		s.serveContainer(resp, req)
+	default:
+		http.Error(resp, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) serveContainer(resp http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/containers/"), "/", 2)
+	c := s.findContainer(parts[0])
+	if c == nil {
+		http.Error(resp, "no such container", http.StatusNotFound)
+		return
+	}
+	var action string
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && req.Method == http.MethodDelete:
+		if c.State.Running {
+			s.emit("kill", c)
+			s.emit("die", c)
+		}
+		delete(s.containers, c.ID)
+		delete(s.files, c.ID)
+		s.emit("destroy", c)
+		resp.WriteHeader(http.StatusNoContent)
+	case action == "json":
+		writeJSON(resp, c)
+	case action == "archive" && req.Method == http.MethodPut:
+		if c.HostConfig != nil && c.HostConfig.ReadonlyRootfs {
+			http.Error(resp, "container rootfs is marked read-only", http.StatusForbidden)
+			return
+		}
+		dir := req.URL.Query().Get("path")
+		if s.files[c.ID] == nil {
+			s.files[c.ID] = map[string]File{}
+		}
+		tr := tar.NewReader(req.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusBadRequest)
+				return
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.files[c.ID][path.Join(dir, hdr.Name)] = File{
+				Content: content,
+				UID:     hdr.Uid,
+				GID:     hdr.Gid,
+				Mode:    hdr.Mode,
+			}
+		}
+		resp.WriteHeader(http.StatusOK)
+	case action == "start":
+		if c.State.Running {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		c.State.Running = true
+		c.State.Status = "running"
+		c.State.StartedAt = time.Now()
+		s.emit("start", c)
+		for _, ref := range s.refs(c) {
+			if code, ok := s.exitCodes[ref]; ok {
+				c.State.Running = false
+				c.State.Status = "exited"
+				c.State.ExitCode = code
+				c.State.FinishedAt = time.Now()
+				s.emit("die", c)
+				break
+			}
+		}
+		if hc := c.Config.Healthcheck; hc != nil && len(hc.Test) > 0 && hc.Test[0] != "NONE" {
+			c.State.Health.Status = "healthy"
+			for _, ref := range s.refs(c) {
+				if status, ok := s.health[ref]; ok {
+					c.State.Health.Status = status
+					break
+				}
+			}
+			check := docker.HealthCheck{
+				Start:  time.Now(),
+				End:    time.Now(),
+				Output: "ok",
+			}
+			if c.State.Health.Status == "unhealthy" {
+				check.ExitCode = 1
+				check.Output = "health check failed"
+			}
+			c.State.Health.Log = append(c.State.Health.Log, check)
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	case action == "stop":
+		if !c.State.Running {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		c.State.Running = false
+		c.State.Status = "exited"
+		c.State.FinishedAt = time.Now()
+		s.emit("die", c)
+		s.emit("stop", c)
+		resp.WriteHeader(http.StatusNoContent)
+	case action == "restart" && req.Method == http.MethodPost:
+		if c.State.Running {
+			s.emit("kill", c)
+			s.emit("die", c)
+		}
+		c.State.Running = true
+		c.State.Status = "running"
+		c.State.StartedAt = time.Now()
+		s.emit("start", c)
+		s.emit("restart", c)
+		resp.WriteHeader(http.StatusNoContent)
+	case action == "rename":
+		name := req.URL.Query().Get("name")
+		if s.findContainer(name) != nil {
+			http.Error(resp, "name already in use", http.StatusConflict)
+			return
+		}
+		oldName := c.Name
+		c.Name = "/" + name
+		s.emit("rename", c, "oldName", oldName)
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(resp, "not found", http.StatusNotFound)
+	}
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(resp).Encode(v)
+}
@@ -0,0 +1,109 @@
+// Package registrytest implements a fake Docker registry for use in
+// tests. It serves the manifest digests of tags over the v2 API,
+// optionally requiring bearer tokens issued by its own token service.
+package registrytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// token is the bearer token issued by the token service.
+const token = "registrytest-token"
+
+// Server is a fake Docker registry.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	digests  map[string]string
+	username string
+	password string
+	requests int
+}
+
+// NewServer starts a new fake Docker registry.
+func NewServer() *Server {
+	s := &Server{
+		digests: map[string]string{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the host of the registry, for
+// use as the prefix of repository names.
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// SetDigest sets the digest of the manifest the tag
+// of the repository refers to. The repository is the
+// path of the repository within the registry.
+func (s *Server) SetDigest(repository, tag, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.digests[repository+":"+tag] = digest
+}
+
+// RequireAuth makes the registry require bearer tokens, which
+// the token service only issues for the provided credentials.
+func (s *Server) RequireAuth(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username = username
+	s.password = password
+}
+
+// Requests returns the number of manifest requests served.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serve(resp http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		username, password, _ := req.BasicAuth()
+		if username != s.username || password != s.password {
+			http.Error(resp, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(resp).Encode(map[string]string{"token": token})
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.Error(resp, "not found", http.StatusNotFound)
+		return
+	}
+
+	if s.username != "" && req.Header.Get("Authorization") != "Bearer "+token {
+		resp.Header().Set("WWW-Authenticate", `Bearer realm="`+s.URL+`/token",service="registrytest",scope="repository:test:pull"`)
+		http.Error(resp, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	i := strings.LastIndex(path, "/manifests/")
+	if i < 0 {
+		http.Error(resp, "not found", http.StatusNotFound)
+		return
+	}
+	s.requests++
+	digest, ok := s.digests[path[:i]+":"+path[i+len("/manifests/"):]]
+	if !ok {
+		http.Error(resp, "manifest unknown", http.StatusNotFound)
+		return
+	}
+
+	resp.Header().Set("Docker-Content-Digest", digest)
+	resp.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/deploy"
 	"github.com/johanbrandhorst/redeploy/handler"
+	"github.com/johanbrandhorst/redeploy/history"
+	"github.com/johanbrandhorst/redeploy/registry"
 )
 
 var port = flag.String("port", "8555", "The port to serve on.")
@@ -24,6 +31,32 @@ var path = flag.String("path", "", "The path to serve Docker Hub webhooks on. If
 var tlsCert = flag.String("tls-cert", "", "The x509 certificate to serve with, in PEM format. Optional.")
 var tlsKey = flag.String("tls-key", "", "The private key to serve with, in PEM format. Optional.")
 var logLevel = flag.Int("log-level", int(logrus.InfoLevel), "Logrus log level to use. 0 is Panic, 5 is Debug.")
+var token = flag.String("token", "", "Shared secret required in the \"token\" query parameter or the X-Redeploy-Token header. Optional.")
+var signatureSecret = flag.String("signature-secret", "", "Secret used to verify HMAC-SHA256 signatures of request bodies. Optional.")
+var signatureHeader = flag.String("signature-header", "X-Redeploy-Signature", "The header containing the HMAC-SHA256 signature of the request body.")
+var workers = flag.Int("workers", 4, "The number of deploy jobs to execute concurrently. Deploys of the same service are always serialized.")
+var debounce = flag.Duration("debounce", 0, "How long to wait for further pushes to a service before deploying it.")
+var healthTimeout = flag.Duration("health-timeout", 2*time.Minute, "How long to wait for new containers to become healthy.")
+var monitor = flag.Duration("monitor", 5*time.Second, "How long new containers without a health check have to keep running to be considered healthy.")
+var stateDir = flag.String("state-dir", "", "The directory to store the deploy history in. If unspecified, no history is kept.")
+var secretsDir = flag.String("secrets-dir", deploy.DefaultSecretsDir, "The directory to write secrets and configs to, which are bind-mounted into the containers. If redeploy runs in a container, mount it at the same path on the host.")
+var historyMaxRecords = flag.Int("history-max-records", 10000, "The number of deploy records to keep. 0 keeps all records.")
+var historyMaxAge = flag.Duration("history-max-age", 0, "How long to keep deploy records. 0 keeps records regardless of age.")
+var pollInterval = flag.Duration("poll-interval", 0, "How often to poll registries for changes to the images of the services. If unspecified, registries are not polled.")
+var pollJitter = flag.Duration("poll-jitter", 0, "The maximum random duration added to the poll interval.")
+var insecureRegistries = flag.String("insecure-registries", "", "Comma separated list of registries to poll over plain HTTP. Optional.")
+var registryPath = flag.String("registry-path", "registry", "The path to serve Docker registry notifications on.")
+var registryHost = flag.String("registry-host", "", "The registry host to prefix repositories of registry notifications with. If unspecified, the host images were pushed to is used.")
+var registryToken = flag.String("registry-token", "", "Bearer token required in the Authorization header of registry notifications. If unspecified, the token of --token is required. Optional.")
+var githubPath = flag.String("github-path", "github", "The path to serve GitHub package webhooks on.")
+var githubSecret = flag.String("github-secret", "", "The secret of the GitHub webhook, used to verify its X-Hub-Signature-256 header. If unspecified, the token of --token is required. Optional.")
+var callbackHosts = flag.String("callback-hosts", handler.DockerHubCallbackHost, "Comma separated list of hosts Docker Hub callbacks may be sent to.")
+var publicURL = flag.String("public-url", "", "The external URL redeploy is reachable on, used to link to jobs in Docker Hub callbacks. Optional.")
+var driftInterval = flag.Duration("drift-interval", 0, "How often to check all containers for drift from the configuration, in addition to checking them on Docker events. If unspecified, drift is not detected.")
+var configPollInterval = flag.Duration("config-poll-interval", 5*time.Second, "How often to check the configuration file for changes, reloading it when it has changed. 0 disables reloading on changes; the configuration is always reloaded on SIGHUP.")
+var redeployChanged = flag.Bool("redeploy-changed", false, "Deploy services that were added, and redeploy services whose configuration changed, when the configuration is reloaded. Without it, services are not scaled to a changed number of replicas until they are deployed again.")
+var reconcile = flag.String("reconcile", "off", "Which services to redeploy on startup: off, missing (services without a container) or drift (also services whose container differs from the configuration).")
+var allowedIPs = flag.String("allowed-ips", "", "Comma separated list of IP addresses and CIDR ranges allowed to call the webhook. Optional.")
 
 func main() {
 	flag.Parse()
@@ -40,12 +73,177 @@ func main() {
 		ForceColors:     true,
 	}
 
-	hook, err := handler.New(conf, handler.WithLogger(log))
+	keychain, err := registry.NewKeychain(registry.DockerConfigPath(), conf.Redeploy.Registries)
+	if err != nil {
+		log.Fatalln("Failed to load registry credentials:", err)
+	}
+
+	opts := []deploy.DeployerOption{
+		deploy.WithLogger(log),
+		deploy.WithKeychain(keychain),
+		deploy.WithWorkers(*workers),
+		deploy.WithDebounce(*debounce),
+		deploy.WithHealthTimeout(*healthTimeout),
+		deploy.WithMonitor(*monitor),
+		deploy.WithSecretsDir(*secretsDir),
+	}
+
+	if *pollInterval > 0 {
+		var insecure []string
+		if *insecureRegistries != "" {
+			insecure = strings.Split(*insecureRegistries, ",")
+		}
+		client := registry.NewClient(keychain, registry.WithInsecureRegistries(insecure...))
+		opts = append(opts, deploy.WithPolling(client, *pollInterval, *pollJitter))
+	}
+
+	if *driftInterval > 0 {
+		opts = append(opts, deploy.WithDriftDetection(*driftInterval))
+	}
+
+	var store *history.Store
+	if *stateDir != "" {
+		store, err = history.Open(*stateDir,
+			history.WithMaxRecords(*historyMaxRecords),
+			history.WithMaxAge(*historyMaxAge),
+		)
+		if err != nil {
+			log.Fatalln("Failed to open history:", err)
+		}
+		opts = append(opts, deploy.WithHistory(store))
+	}
+
+	deployer, err := deploy.New(conf, opts...)
+	if err != nil {
+		log.Fatalln("Failed to connect to Docker:", err)
+	}
+
+	reconcileMode, err := deploy.ParseReconcileMode(*reconcile)
+	if err != nil {
+		log.Fatalln("Failed to parse reconcile mode:", err)
+	}
+	jobs, err := deployer.Reconcile(context.Background(), reconcileMode)
+	if err != nil {
+		log.WithError(err).Error("Failed to reconcile services")
+	}
+	for _, job := range jobs {
+		log.WithFields(logrus.Fields{
+			"job":      job.ID,
+			"services": job.Services,
+		}).Info("Queued reconciliation")
+	}
+
+	var auth []handler.Authenticator
+	if *allowedIPs != "" {
+		allowlist, err := handler.ParseIPAllowlist(strings.Split(*allowedIPs, ","))
+		if err != nil {
+			log.Fatalln("Failed to parse allowed IPs:", err)
+		}
+		auth = append(auth, allowlist)
+	}
+	// Registry notifications and GitHub webhooks
+	// authenticate with their own secret, if configured.
+	registryAuth := auth[:len(auth):len(auth)]
+	githubAuth := auth[:len(auth):len(auth)]
+	sourceAuth := auth[:len(auth):len(auth)]
+	if *token != "" {
+		tokenAuth := handler.TokenAuthenticator{
+			Token:  *token,
+			Header: "X-Redeploy-Token",
+			Param:  "token",
+		}
+		auth = append(auth, tokenAuth)
+		if *registryToken == "" {
+			registryAuth = append(registryAuth, tokenAuth)
+		}
+		if *githubSecret == "" {
+			githubAuth = append(githubAuth, tokenAuth)
+		}
+	}
+	if *registryToken != "" {
+		registryAuth = append(registryAuth, handler.RegistrySource{}.Authenticator(*registryToken))
+	}
+	if *githubSecret != "" {
+		githubAuth = append(githubAuth, handler.GitHubSource{}.Authenticator(*githubSecret))
+	}
+	if *signatureSecret != "" {
+		auth = append(auth, handler.HMACAuthenticator{
+			Secret: []byte(*signatureSecret),
+			Header: *signatureHeader,
+		})
+	}
+
+	var jobsAuth []handler.Authenticator
+	for _, a := range auth {
+		if _, ok := a.(handler.HMACAuthenticator); !ok {
+			jobsAuth = append(jobsAuth, a)
+		}
+	}
+
+	hookOpts := []handler.DockerHookOption{
+		handler.WithLogger(log),
+		handler.WithAuthenticators(auth...),
+		handler.WithCallbackHosts(strings.Split(*callbackHosts, ",")...),
+	}
+	if *publicURL != "" && len(jobsAuth) > 0 {
+		hookOpts = append(hookOpts, handler.WithJobsURL(strings.TrimSuffix(*publicURL, "/")+handler.JobsPath))
+	}
+	hook, err := handler.New(deployer, hookOpts...)
 	if err != nil {
 		log.Fatalln("Failed to create Docker hook:", err)
 	}
 
-	http.Handle("/"+*path, hook)
+	routes := handler.NewRoutes(http.DefaultServeMux)
+	handle := func(name, path string, h http.Handler) {
+		err := routes.Handle(name, path, h)
+		if err != nil {
+			log.Fatalln("Failed to register endpoint:", err)
+		}
+	}
+
+	handle("Docker Hub webhook", route(*path), hook)
+	if len(githubAuth) > 0 {
+		handle("GitHub webhook", route(*githubPath), handler.NewHook(deployer, handler.GitHubSource{}, log, githubAuth...))
+	} else {
+		log.Warn("GitHub webhook disabled, configure a GitHub secret, token or allowed IPs to enable it")
+	}
+	if len(registryAuth) > 0 {
+		handle("registry notifications", route(*registryPath), handler.NewHook(deployer, handler.RegistrySource{Host: *registryHost}, log, registryAuth...))
+	} else {
+		log.Warn("Registry notifications disabled, configure a registry token, token or allowed IPs to enable them")
+	}
+	for _, w := range conf.Redeploy.Webhooks {
+		var source handler.Source
+		if w.Format == "generic" {
+			source, err = handler.NewGenericSource(w.Repository, w.Tag, w.Digest)
+		} else {
+			source, err = handler.NewSource(w.Format)
+		}
+		if err != nil {
+			log.Fatalln("Failed to create webhook:", err)
+		}
+		hookAuth := sourceAuth
+		if w.Token != "" {
+			hookAuth = append(hookAuth, source.Authenticator(w.Token))
+		} else {
+			log.WithField("path", w.Path).Warn("Webhook has no token, anyone who can reach it can trigger deploys")
+		}
+		handle("webhook", w.Path, handler.NewHook(deployer, source, log, hookAuth...))
+	}
+	// Jobs, the management API and the history expose pushers,
+	// images and outcomes, so they are only served if they can
+	// be protected. Status queries have no body to sign.
+	if len(jobsAuth) > 0 {
+		handle("jobs", handler.JobsPath, handler.NewJobs(deployer, log, jobsAuth...))
+		api := handler.NewAPI(deployer, log, jobsAuth...)
+		handle("management API", handler.ServicesPath, api)
+		handle("management API", handler.ServicesPath+"/", api)
+		if store != nil {
+			handle("history", handler.HistoryPath, handler.NewHistory(store, log, jobsAuth...))
+		}
+	} else {
+		log.Warn("Jobs, management API and history disabled, configure a token or allowed IPs to enable them")
+	}
 
 	srv := &http.Server{
 		Addr:    net.JoinHostPort(*host, *port),
@@ -55,10 +253,10 @@ func main() {
 	go func() {
 		var err error
 		if *tlsCert != "" && *tlsKey != "" {
-			log.Print("Serving on https://", srv.Addr, "/"+*path)
+			log.Print("Serving on https://", srv.Addr, route(*path))
 			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
 		} else {
-			log.Print("Serving on http://", srv.Addr, "/"+*path)
+			log.Print("Serving on http://", srv.Addr, route(*path))
 			err = srv.ListenAndServe()
 		}
 		if err != nil && err != http.ErrServerClosed {
@@ -66,6 +264,8 @@ func main() {
 		}
 	}()
 
+	go watchConfig(log, deployer, conf)
+
 	cancel := make(chan os.Signal, 1)
 	signal.Notify(cancel, syscall.SIGTERM, syscall.SIGINT)
 	<-cancel
@@ -74,5 +274,97 @@ func main() {
 		log.Fatalln("Failed to shut down:", err)
 	}
 
+	deployer.Close()
+	if store != nil {
+		err = store.Close()
+		if err != nil {
+			log.Fatalln("Failed to close history:", err)
+		}
+	}
+
 	log.Println("Shut down gracefully")
 }
+
+// route returns the path of an endpoint configured
+// by flag, with or without a leading slash.
+func route(path string) string {
+	return "/" + strings.TrimPrefix(path, "/")
+}
+
+// watchConfig reloads the configuration on SIGHUP and when
+// the configuration file changes, until the process exits.
+func watchConfig(logger *logrus.Logger, deployer *deploy.Deployer, conf *config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if *configPollInterval > 0 {
+		ticker := time.NewTicker(*configPollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to read config file")
+	}
+	for {
+		select {
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading config")
+		case <-tick:
+			data, err := ioutil.ReadFile(*confFile)
+			if err != nil || bytes.Equal(data, last) {
+				// Unchanged, or briefly missing while being saved
+				continue
+			}
+			logger.Info("Config file changed, reloading config")
+		}
+
+		last, _ = ioutil.ReadFile(*confFile)
+		reloadConfig(logger, deployer, conf)
+	}
+}
+
+// reloadConfig loads the configuration file and swaps it into the
+// deployer, keeping the current configuration if it is invalid.
+// Changes to the x-redeploy section require a restart.
+func reloadConfig(logger *logrus.Logger, deployer *deploy.Deployer, startup *config.Config) {
+	conf, err := config.LoadConfig(*confFile)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load config, keeping current config")
+		return
+	}
+	changes, err := deployer.Reload(conf)
+	if err != nil {
+		logger.WithError(err).Error("Invalid config, keeping current config")
+		return
+	}
+	if !reflect.DeepEqual(conf.Redeploy, startup.Redeploy) {
+		logger.Warn("Changes to x-redeploy take effect on restart")
+	}
+	if changes.Empty() {
+		logger.Info("Reloaded config, no services changed")
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"added":   changes.Added,
+		"removed": changes.Removed,
+		"changed": changes.Changed,
+	}).Info("Reloaded config")
+
+	if !*redeployChanged {
+		return
+	}
+	for _, name := range append(changes.Added, changes.Changed...) {
+		job, err := deployer.Redeploy(name, nil)
+		if err != nil {
+			logger.WithError(err).WithField("name", name).Error("Failed to queue redeploy of added or changed service")
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"job":  job.ID,
+			"name": name,
+		}).Info("Redeploying added or changed service")
+	}
+}
@@ -0,0 +1,110 @@
+// Package policy implements tag policies, which select the
+// tags of a repository that a service follows.
+package policy
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Policy selects the tags of a repository to deploy.
+type Policy interface {
+	// Match reports whether the tag is selected by the policy.
+	Match(tag string) bool
+	// Older reports whether tag a is older than tag b.
+	// Policies without an order of tags always return false.
+	Older(a, b string) bool
+}
+
+// Parse parses a policy of the form <kind>:<pattern>, where kind is
+// one of glob, regex or semver. Glob patterns use the syntax of
+// path.Match, regular expressions must match the whole tag, and
+// semver ranges use the syntax of npm, such as ^1.4 or >=1.2.0 <2.0.0.
+func Parse(s string) (Policy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid tag policy %q: expected <kind>:<pattern>", s)
+	}
+
+	switch kind, pattern := parts[0], parts[1]; kind {
+	case "glob":
+		// Check the syntax of the pattern
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag policy %q", s)
+		}
+		return Glob(pattern), nil
+	case "regex":
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag policy %q", s)
+		}
+		return Regex{re}, nil
+	case "semver":
+		r, err := parseRange(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag policy %q", s)
+		}
+		return Semver{r}, nil
+	default:
+		return nil, errors.Errorf("invalid tag policy %q: unknown kind %q", s, kind)
+	}
+}
+
+// Glob selects tags matching a shell pattern.
+type Glob string
+
+// Match implements Policy.
+func (g Glob) Match(tag string) bool {
+	ok, _ := path.Match(string(g), tag)
+	return ok
+}
+
+// Older implements Policy.
+func (g Glob) Older(a, b string) bool {
+	return false
+}
+
+// Regex selects tags matching a regular expression.
+type Regex struct {
+	*regexp.Regexp
+}
+
+// Match implements Policy.
+func (r Regex) Match(tag string) bool {
+	return r.MatchString(tag)
+}
+
+// Older implements Policy.
+func (r Regex) Older(a, b string) bool {
+	return false
+}
+
+// Semver selects tags that are semantic
+// versions within a range.
+type Semver struct {
+	r semverRange
+}
+
+// Match implements Policy.
+func (s Semver) Match(tag string) bool {
+	v, ok := parseVersion(tag)
+	return ok && s.r.contains(v)
+}
+
+// Older implements Policy. Tags that
+// are not semantic versions are never older.
+func (s Semver) Older(a, b string) bool {
+	va, ok := parseVersion(a)
+	if !ok {
+		return false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return false
+	}
+	return va.compare(vb) < 0
+}
@@ -0,0 +1,138 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/johanbrandhorst/redeploy/policy"
+)
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		Policy     string
+		Matches    []string
+		Mismatches []string
+	}{
+		{
+			Policy:     "glob:v1.*",
+			Matches:    []string{"v1.0", "v1.4.7", "v1.x"},
+			Mismatches: []string{"v2.0", "1.4.7", "latest"},
+		},
+		{
+			Policy:     `regex:v1\.[0-9]+`,
+			Matches:    []string{"v1.0", "v1.42"},
+			Mismatches: []string{"v1.4.7", "xv1.0", "v1.0x"},
+		},
+		{
+			Policy:     "semver:~1.4",
+			Matches:    []string{"1.4.0", "1.4.7", "v1.4.7", "1.4.7+build.1"},
+			Mismatches: []string{"1.3.9", "1.5.0", "1.4.8-rc.1", "1.4", "latest"},
+		},
+		{
+			Policy:     "semver:~1.4.2",
+			Matches:    []string{"1.4.2", "1.4.9"},
+			Mismatches: []string{"1.4.1", "1.5.0"},
+		},
+		{
+			Policy:     "semver:^1.4",
+			Matches:    []string{"1.4.0", "1.9.3"},
+			Mismatches: []string{"1.3.0", "2.0.0", "2.0.0-rc.1"},
+		},
+		{
+			Policy:     "semver:^0.2.3",
+			Matches:    []string{"0.2.3", "0.2.9"},
+			Mismatches: []string{"0.3.0", "0.2.2"},
+		},
+		{
+			Policy:     "semver:*",
+			Matches:    []string{"0.0.1", "1.2.3", "10.0.0"},
+			Mismatches: []string{"1.2.3-beta", "latest"},
+		},
+		{
+			Policy:     "semver:1.x",
+			Matches:    []string{"1.0.0", "1.99.0"},
+			Mismatches: []string{"2.0.0", "0.9.0"},
+		},
+		{
+			Policy:     "semver:>=1.2.0 <2.0.0 || 3.1.4",
+			Matches:    []string{"1.2.0", "1.9.9", "3.1.4"},
+			Mismatches: []string{"1.1.9", "2.0.0", "3.1.5"},
+		},
+		{
+			Policy:     "semver:>=1.2.3-beta.2 <1.3",
+			Matches:    []string{"1.2.3-beta.2", "1.2.3-beta.10", "1.2.3", "1.2.9"},
+			Mismatches: []string{"1.2.3-beta.1", "1.2.4-beta.3", "1.3.0"},
+		},
+		{
+			Policy:     "semver:>1.4",
+			Matches:    []string{"1.5.0", "2.0.0"},
+			Mismatches: []string{"1.4.9"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		p, err := policy.Parse(testCase.Policy)
+		if err != nil {
+			t.Errorf("For %s: unexpected error: %v", testCase.Policy, err)
+			continue
+		}
+		for _, tag := range testCase.Matches {
+			if !p.Match(tag) {
+				t.Errorf("For %s: expected %q to match", testCase.Policy, tag)
+			}
+		}
+		for _, tag := range testCase.Mismatches {
+			if p.Match(tag) {
+				t.Errorf("For %s: expected %q not to match", testCase.Policy, tag)
+			}
+		}
+	}
+}
+
+func TestOlder(t *testing.T) {
+	semver, err := policy.Parse("semver:^1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	glob, err := policy.Parse("glob:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Policy   policy.Policy
+		A, B     string
+		Expected bool
+	}{
+		{semver, "1.4.3", "1.4.7", true},
+		{semver, "1.4.7", "1.4.3", false},
+		{semver, "1.4.7", "1.4.7", false},
+		{semver, "1.10.0", "1.9.0", false},
+		{semver, "1.4.7-rc.1", "1.4.7", true},
+		{semver, "1.4.7-rc.2", "1.4.7-rc.10", true},
+		{semver, "1.4.7-alpha", "1.4.7-1", false},
+		{semver, "latest", "1.4.7", false},
+		{glob, "1.4.3", "1.4.7", false},
+	}
+
+	for _, testCase := range testCases {
+		if got := testCase.Policy.Older(testCase.A, testCase.B); got != testCase.Expected {
+			t.Errorf("For %s older than %s: got %t, expected %t", testCase.A, testCase.B, got, testCase.Expected)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, p := range []string{
+		"v1.*",
+		"wildcard:v1.*",
+		"glob:[",
+		"regex:(",
+		"semver:^1.x.2.3",
+		"semver:~01.4",
+		"semver:1.x-beta",
+	} {
+		if _, err := policy.Parse(p); err == nil {
+			t.Errorf("For %s: expected error", p)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package policy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// version is a semantic version, see https://semver.org.
+type version struct {
+	major, minor, patch int
+	pre                 []string
+}
+
+// parseVersion parses a complete semantic version,
+// optionally prefixed with a v. Build metadata is ignored.
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	var v version
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return v, false
+			}
+		}
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	nums := make([]int, 3)
+	for i, part := range parts {
+		n, err := parseNumber(part)
+		if err != nil {
+			return v, false
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func parseNumber(s string) (int, error) {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return 0, errors.Errorf("invalid version number %q", s)
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, errors.Errorf("invalid version number %q", s)
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// compare returns -1, 0 or 1 if v is lower than,
+// equal to or higher than o, respectively.
+func (v version) compare(o version) int {
+	for _, c := range [][2]int{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if c[0] != c[1] {
+			if c[0] < c[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A version without prerelease has higher precedence
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := compareIdentifier(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifier compares prerelease identifiers. Numeric
+// identifiers are compared numerically and have lower
+// precedence than alphanumeric ones.
+func compareIdentifier(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// comparator is a single constraint on a version, such as >=1.2.3.
+type comparator struct {
+	op string
+	v  version
+	// bound is set for the bounds implied by partial
+	// versions, which don't allow prereleases.
+	bound bool
+}
+
+func (c comparator) matches(v version) bool {
+	cmp := v.compare(c.v)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// semverRange is a set of alternative comparator sets,
+// following the range syntax of npm. A version is in the
+// range if it satisfies all comparators of any set.
+type semverRange [][]comparator
+
+// parseRange parses ranges such as "^1.4", "~1.4.2", "1.x",
+// ">=1.2.0 <2.0.0" and "1.2.3 || 2.x". The empty range
+// and "*" match all versions without prerelease.
+func parseRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, alt := range strings.Split(s, "||") {
+		set := []comparator{}
+		for _, field := range strings.Fields(alt) {
+			cs, err := parseComparator(field)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, cs...)
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+// parsePartial parses a possibly partial version such as
+// 1, 1.4, 1.x or 1.4.*, returning the number of components given.
+func parsePartial(s string) (version, int, error) {
+	s = strings.TrimPrefix(s, "v")
+	var v version
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, errors.Errorf("invalid version %q", s)
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	n := 0
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		num, err := parseNumber(part)
+		if err != nil {
+			return v, 0, err
+		}
+		*nums[n] = num
+		n++
+	}
+	if n < 3 && len(v.pre) > 0 {
+		return v, 0, errors.Errorf("invalid version %q: prerelease requires a complete version", s)
+	}
+	return v, n, nil
+}
+
+// parseComparator parses a single range term
+// into the comparators it is equivalent to.
+func parseComparator(s string) ([]comparator, error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, s[len(prefix):]
+			break
+		}
+	}
+
+	v, n, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// upper returns the lowest version above all
+	// versions matching the first i components of v.
+	upper := func(i int) version {
+		if i == 1 {
+			return version{major: v.major + 1, pre: []string{"0"}}
+		}
+		return version{major: v.major, minor: v.minor + 1, pre: []string{"0"}}
+	}
+	below := func(i int) comparator {
+		return comparator{op: "<", v: upper(i), bound: true}
+	}
+
+	switch op {
+	case "", "=":
+		switch n {
+		case 0:
+			return nil, nil
+		case 3:
+			return []comparator{{op: "=", v: v}}, nil
+		}
+		return []comparator{{op: ">=", v: v}, below(n)}, nil
+	case "^":
+		switch {
+		case n == 0:
+			return nil, nil
+		case v.major > 0 || n == 1:
+			return []comparator{{op: ">=", v: v}, below(1)}, nil
+		case v.minor > 0 || n == 2:
+			return []comparator{{op: ">=", v: v}, below(2)}, nil
+		}
+		return []comparator{{op: "=", v: v}}, nil
+	case "~":
+		switch n {
+		case 0:
+			return nil, nil
+		case 1:
+			return []comparator{{op: ">=", v: v}, below(1)}, nil
+		}
+		return []comparator{{op: ">=", v: v}, below(2)}, nil
+	case ">", "<=":
+		if n == 0 {
+			if op == ">" {
+				// Nothing is greater than everything
+				return []comparator{{op: "<", v: version{}}}, nil
+			}
+			return nil, nil
+		}
+		if n < 3 {
+			// >1.4 means >=1.5.0-0, <=1.4 means <1.5.0-0
+			if op == ">" {
+				return []comparator{{op: ">=", v: upper(n), bound: true}}, nil
+			}
+			return []comparator{below(n)}, nil
+		}
+	case ">=", "<":
+		if n == 0 {
+			if op == "<" {
+				return []comparator{{op: "<", v: version{}}}, nil
+			}
+			return nil, nil
+		}
+	}
+
+	return []comparator{{op: op, v: v}}, nil
+}
+
+// contains reports whether the version is in the range.
+// Prereleases are only contained if a comparator of the
+// matching set is a prerelease of the same major, minor
+// and patch version.
+func (r semverRange) contains(v version) bool {
+	for _, set := range r {
+		if setContains(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func setContains(set []comparator, v version) bool {
+	for _, c := range set {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	if len(v.pre) == 0 {
+		return true
+	}
+	for _, c := range set {
+		if !c.bound && len(c.v.pre) > 0 &&
+			c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+// Package registry implements access to Docker registries,
+// resolving the credentials used to authenticate with them.
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// dockerHubServer is the server address Docker Hub
+// credentials are stored under by the Docker CLI.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// Host returns the registry host of the repository.
+// Repositories without a registry host are on Docker Hub.
+func Host(repository string) string {
+	i := strings.Index(repository, "/")
+	if i < 0 {
+		return config.DockerHub
+	}
+	host := repository[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return config.DockerHub
+	}
+	return normalizeHost(host)
+}
+
+// normalizeHost strips the scheme and path from a registry
+// address and maps the Docker Hub aliases to DockerHub.
+func normalizeHost(addr string) string {
+	addr = strings.TrimPrefix(addr, "https://")
+	addr = strings.TrimPrefix(addr, "http://")
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+	switch addr {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return config.DockerHub
+	}
+	return addr
+}
+
+// dockerConfigFile is the subset of the Docker
+// CLI configuration file concerning credentials.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// Keychain resolves the credentials to use for a registry.
+// Credentials are looked up in the following order:
+// explicitly configured credentials, the credential helper
+// configured for the registry, the credentials stored in the
+// Docker CLI configuration file, and the default credential store.
+type Keychain struct {
+	explicit    map[string]docker.AuthConfiguration
+	auths       map[string]docker.AuthConfiguration
+	credsStore  string
+	credHelpers map[string]string
+}
+
+// DockerConfigPath returns the path of the Docker CLI configuration
+// file, $DOCKER_CONFIG/config.json or ~/.docker/config.json.
+func DockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// NewKeychain creates a keychain from the explicitly configured
+// credentials and the Docker CLI configuration file at the path.
+// A missing configuration file is not an error.
+func NewKeychain(dockerConfig string, explicit map[string]config.RegistryAuth) (*Keychain, error) {
+	k := &Keychain{
+		explicit:    map[string]docker.AuthConfiguration{},
+		auths:       map[string]docker.AuthConfiguration{},
+		credHelpers: map[string]string{},
+	}
+
+	for host, auth := range explicit {
+		host = normalizeHost(host)
+		k.explicit[host] = docker.AuthConfiguration{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			ServerAddress: serverAddress(host),
+		}
+	}
+
+	b, err := ioutil.ReadFile(dockerConfig)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read Docker configuration")
+	}
+
+	var file dockerConfigFile
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse Docker configuration %s", dockerConfig)
+	}
+
+	for addr, auth := range file.Auths {
+		host := normalizeHost(addr)
+		username, password := auth.Username, auth.Password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.Errorf("failed to parse Docker configuration %s: invalid auth for %s", dockerConfig, addr)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("failed to parse Docker configuration %s: invalid auth for %s", dockerConfig, addr)
+			}
+			username, password = parts[0], parts[1]
+		}
+		if username == "" {
+			// Entries without credentials are used by
+			// the credential store to list registries.
+			continue
+		}
+		k.auths[host] = docker.AuthConfiguration{
+			Username:      username,
+			Password:      password,
+			ServerAddress: serverAddress(host),
+		}
+	}
+
+	for addr, helper := range file.CredHelpers {
+		k.credHelpers[normalizeHost(addr)] = helper
+	}
+	k.credsStore = file.CredsStore
+
+	return k, nil
+}
+
+// Credentials returns the credentials to use for the registry
+// of the repository. If no credentials are configured for the
+// registry, empty credentials are returned.
+func (k *Keychain) Credentials(repository string) (docker.AuthConfiguration, error) {
+	return k.hostCredentials(Host(repository))
+}
+
+func (k *Keychain) hostCredentials(host string) (docker.AuthConfiguration, error) {
+	if auth, ok := k.explicit[host]; ok {
+		return auth, nil
+	}
+	if helper, ok := k.credHelpers[host]; ok {
+		return getCredentials(helper, host)
+	}
+	if auth, ok := k.auths[host]; ok {
+		return auth, nil
+	}
+	if k.credsStore != "" {
+		return getCredentials(k.credsStore, host)
+	}
+
+	return docker.AuthConfiguration{}, nil
+}
+
+// serverAddress returns the address credentials
+// for the registry host are stored under.
+func serverAddress(host string) string {
+	if host == config.DockerHub {
+		return dockerHubServer
+	}
+	return host
+}
+
+// getCredentials gets the credentials for the registry host
+// from a Docker credential helper, an executable on the PATH
+// named docker-credential-<helper>.
+func getCredentials(helper, host string) (docker.AuthConfiguration, error) {
+	addr := serverAddress(host)
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(addr)
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	if err != nil {
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return docker.AuthConfiguration{}, nil
+		}
+		// The output of the helper is not included,
+		// as it may contain the credentials.
+		return docker.AuthConfiguration{}, errors.Wrapf(err, "failed to get credentials for %s from docker-credential-%s", host, helper)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		return docker.AuthConfiguration{}, errors.Errorf("failed to parse credentials for %s from docker-credential-%s", host, helper)
+	}
+	if creds.Username == "<token>" {
+		return docker.AuthConfiguration{}, errors.Errorf("identity token for %s from docker-credential-%s is not supported", host, helper)
+	}
+
+	return docker.AuthConfiguration{
+		Username:      creds.Username,
+		Password:      creds.Secret,
+		ServerAddress: addr,
+	}, nil
+}
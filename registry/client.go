@@ -0,0 +1,271 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/johanbrandhorst/redeploy/config"
+)
+
+// dockerHubEndpoint is the host serving
+// the registry API of Docker Hub.
+const dockerHubEndpoint = "registry-1.docker.io"
+
+// manifestTypes are the manifest media types accepted when
+// resolving digests, so that the digest matches the one
+// recorded by the Docker daemon when pulling.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// Client queries the v2 API of registries.
+type Client struct {
+	keychain *Keychain
+	client   *http.Client
+	insecure map[string]bool
+}
+
+// ClientOption is used to configure a Client.
+type ClientOption func(*Client)
+
+// WithHTTPClient configures the HTTP client to use.
+// Defaults to a client with a timeout of 30 seconds.
+func WithHTTPClient(c *http.Client) ClientOption {
+	return func(r *Client) {
+		r.client = c
+	}
+}
+
+// WithInsecureRegistries configures registries to access over
+// plain HTTP. Registries on localhost and 127.0.0.1 are always
+// accessed over plain HTTP.
+func WithInsecureRegistries(hosts ...string) ClientOption {
+	return func(r *Client) {
+		for _, host := range hosts {
+			r.insecure[normalizeHost(host)] = true
+		}
+	}
+}
+
+// NewClient creates a new Client authenticating with the
+// credentials of the keychain. If keychain is nil,
+// registries are accessed anonymously.
+func NewClient(keychain *Keychain, opts ...ClientOption) *Client {
+	c := &Client{
+		keychain: keychain,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		insecure: map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Digest returns the digest of the manifest
+// the tag of the repository refers to.
+func (c *Client) Digest(ctx context.Context, repository, tag string) (string, error) {
+	host := Host(repository)
+	u := c.baseURL(host) + "/v2/" + Path(repository) + "/manifests/" + tag
+
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to query registry")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		err = c.authorize(ctx, req, host, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		resp, err = c.client.Do(req)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to query registry")
+		}
+		resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status querying manifest of %s:%s: %s", repository, tag, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.Errorf("registry returned no digest for %s:%s", repository, tag)
+	}
+
+	return digest, nil
+}
+
+// Path returns the path of the repository within its registry.
+// Official images on Docker Hub live in the library namespace.
+func Path(repository string) string {
+	host := Host(repository)
+	if i := strings.Index(repository, "/"); i >= 0 {
+		first := repository[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			repository = repository[i+1:]
+		}
+	}
+	if host == config.DockerHub && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return repository
+}
+
+func (c *Client) baseURL(host string) string {
+	if host == config.DockerHub {
+		return "https://" + dockerHubEndpoint
+	}
+	hostname := host
+	if i := strings.LastIndex(hostname, ":"); i >= 0 {
+		hostname = hostname[:i]
+	}
+	if c.insecure[host] || hostname == "localhost" || hostname == "127.0.0.1" {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// authorize adds authorization to the request according to
+// the challenge returned by the registry.
+func (c *Client) authorize(ctx context.Context, req *http.Request, host, challenge string) error {
+	var username, password string
+	if c.keychain != nil {
+		auth, err := c.keychain.hostCredentials(host)
+		if err != nil {
+			return err
+		}
+		username, password = auth.Username, auth.Password
+	}
+
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return errors.Errorf("registry %s requires credentials", host)
+		}
+		req.SetBasicAuth(username, password)
+		return nil
+	case "bearer":
+		token, err := c.token(ctx, params, username, password)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	default:
+		return errors.Errorf("unsupported authentication challenge from registry %s", host)
+	}
+}
+
+// token requests a bearer token from the token
+// service described by the challenge parameters.
+func (c *Client) token(ctx context.Context, params map[string]string, username, password string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", errors.New("invalid token realm in registry challenge")
+	}
+	q := realm.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		q.Set("scope", scope)
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to request registry token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status requesting registry token: %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse registry token")
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+
+	return "", errors.New("registry token response contained no token")
+}
+
+// parseChallenge parses a WWW-Authenticate header of the
+// form `Bearer realm="...",service="...",scope="..."`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return parts[0], params
+}
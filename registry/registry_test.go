@@ -0,0 +1,229 @@
+package registry_test
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-test/deep"
+
+	"github.com/johanbrandhorst/redeploy/config"
+	"github.com/johanbrandhorst/redeploy/internal/registrytest"
+	"github.com/johanbrandhorst/redeploy/registry"
+)
+
+func TestHost(t *testing.T) {
+	for repo, expected := range map[string]string{
+		"ubuntu":                                config.DockerHub,
+		"jfbrandhorst/redeploy":                 config.DockerHub,
+		"docker.io/jfbrandhorst/redeploy":       config.DockerHub,
+		"index.docker.io/jfbrandhorst/redeploy": config.DockerHub,
+		"quay.io/coreos/etcd":                   "quay.io",
+		"localhost/test":                        "localhost",
+		"localhost:5000/test":                   "localhost:5000",
+		"registry.example.com:443/a/b/c":        "registry.example.com:443",
+	} {
+		if got := registry.Host(repo); got != expected {
+			t.Errorf("For %s: got host %q, expected %q", repo, got, expected)
+		}
+	}
+}
+
+// writeHelper writes a Docker credential helper
+// printing the output when asked for credentials.
+func writeHelper(t *testing.T, dir, name, output string, code int) {
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = get ] || exit 1\n" +
+		"server=$(cat)\n" +
+		"echo '" + output + "' | sed \"s|SERVER|$server|g\"\n" +
+		"exit " + strconv.Itoa(code) + "\n"
+	err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeychain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeHelper(t, dir, "store", `{"ServerURL":"SERVER","Username":"store","Secret":"SERVER"}`, 0)
+	writeHelper(t, dir, "ecr", `{"ServerURL":"SERVER","Username":"AWS","Secret":"token"}`, 0)
+	writeHelper(t, dir, "missing", "credentials not found in native keychain", 1)
+	writeHelper(t, dir, "broken", "secret output", 2)
+
+	path := os.Getenv("PATH")
+	err = os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", path)
+
+	auth := func(userpass string) string {
+		return base64.StdEncoding.EncodeToString([]byte(userpass))
+	}
+	confPath := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(confPath, []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+auth("hub:hubpass")+`"},
+		"quay.io": {"auth": "`+auth("quay:quaypass")+`"},
+		"registry.example.com": {"auth": "`+auth("file:filepass")+`"},
+		"listed.example.com": {}
+	},
+	"credsStore": "store",
+	"credHelpers": {
+		"123.dkr.ecr.us-east-1.amazonaws.com": "ecr",
+		"missing.example.com": "missing",
+		"broken.example.com": "broken"
+	}
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := registry.NewKeychain(confPath, map[string]config.RegistryAuth{
+		"registry.example.com": {Username: "explicit", Password: "explicitpass"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		Name       string
+		Repository string
+		Expected   docker.AuthConfiguration
+		Error      bool
+	}{
+		{
+			Name:       "DockerHub",
+			Repository: "jfbrandhorst/redeploy",
+			Expected:   docker.AuthConfiguration{Username: "hub", Password: "hubpass", ServerAddress: "https://index.docker.io/v1/"},
+		},
+		{
+			Name:       "ConfigFile",
+			Repository: "quay.io/coreos/etcd",
+			Expected:   docker.AuthConfiguration{Username: "quay", Password: "quaypass", ServerAddress: "quay.io"},
+		},
+		{
+			Name:       "ExplicitOverridesConfigFile",
+			Repository: "registry.example.com/test",
+			Expected:   docker.AuthConfiguration{Username: "explicit", Password: "explicitpass", ServerAddress: "registry.example.com"},
+		},
+		{
+			Name:       "CredHelper",
+			Repository: "123.dkr.ecr.us-east-1.amazonaws.com/test",
+			Expected:   docker.AuthConfiguration{Username: "AWS", Password: "token", ServerAddress: "123.dkr.ecr.us-east-1.amazonaws.com"},
+		},
+		{
+			Name:       "CredsStore",
+			Repository: "listed.example.com/test",
+			Expected:   docker.AuthConfiguration{Username: "store", Password: "listed.example.com", ServerAddress: "listed.example.com"},
+		},
+		{
+			Name:       "CredentialsNotFound",
+			Repository: "missing.example.com/test",
+		},
+		{
+			Name:       "BrokenHelper",
+			Repository: "broken.example.com/test",
+			Error:      true,
+		},
+	} {
+		got, err := k.Credentials(testCase.Repository)
+		if testCase.Error {
+			if err == nil {
+				t.Errorf("For %s: expected error", testCase.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("For %s: unexpected error: %v", testCase.Name, err)
+			continue
+		}
+		if diff := deep.Equal(got, testCase.Expected); diff != nil {
+			t.Errorf("For %s: %v", testCase.Name, diff)
+		}
+	}
+
+	t.Run("NoConfigFile", func(t *testing.T) {
+		k, err := registry.NewKeychain(filepath.Join(dir, "missing.json"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := k.Credentials("jfbrandhorst/redeploy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(got, docker.AuthConfiguration{}); diff != nil {
+			t.Error(diff)
+		}
+	})
+}
+
+func TestPath(t *testing.T) {
+	for repo, expected := range map[string]string{
+		"ubuntu":                          "library/ubuntu",
+		"docker.io/ubuntu":                "library/ubuntu",
+		"jfbrandhorst/redeploy":           "jfbrandhorst/redeploy",
+		"docker.io/jfbrandhorst/redeploy": "jfbrandhorst/redeploy",
+		"quay.io/coreos/etcd":             "coreos/etcd",
+		"localhost:5000/test":             "test",
+	} {
+		if got := registry.Path(repo); got != expected {
+			t.Errorf("For %s: got path %q, expected %q", repo, got, expected)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+
+	s.SetDigest("test/test1", "latest", "sha256:1234")
+
+	c := registry.NewClient(nil)
+	digest, err := c.Digest(context.Background(), s.Host()+"/test/test1", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:1234" {
+		t.Errorf("Got digest %q, expected %q", digest, "sha256:1234")
+	}
+
+	_, err = c.Digest(context.Background(), s.Host()+"/test/test1", "missing")
+	if err == nil {
+		t.Error("Expected error for missing tag")
+	}
+
+	t.Run("BearerToken", func(t *testing.T) {
+		s.RequireAuth("bot", "secret")
+
+		_, err := c.Digest(context.Background(), s.Host()+"/test/test1", "latest")
+		if err == nil {
+			t.Error("Expected error without credentials")
+		}
+
+		k, err := registry.NewKeychain("/nonexistent", map[string]config.RegistryAuth{
+			s.Host(): {Username: "bot", Password: "secret"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := registry.NewClient(k)
+		digest, err := c.Digest(context.Background(), s.Host()+"/test/test1", "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest != "sha256:1234" {
+			t.Errorf("Got digest %q, expected %q", digest, "sha256:1234")
+		}
+	})
+}